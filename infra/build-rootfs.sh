@@ -239,6 +239,8 @@ ExecStart=/usr/local/bin/otus-agent
 Restart=always
 RestartSec=1
 WorkingDirectory=/workspace
+# The agent creates cgroups below its own for executions with resource limits
+Delegate=yes
 
 [Install]
 WantedBy=multi-user.target
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// CgroupRoot is where the cgroup v2 hierarchy is mounted
+	CgroupRoot = "/sys/fs/cgroup"
+	// CgroupRootSlice is the parent of per-execution cgroups when the agent
+	// runs in the root cgroup (not under systemd), where nothing else manages it
+	CgroupRootSlice = CgroupRoot + "/otus-agent"
+	// cgroupAgentLeaf is the child of a delegated cgroup the agent moves itself into
+	cgroupAgentLeaf = "agent"
+	// cpuMaxPeriod is the cpu.max period in microseconds
+	cpuMaxPeriod = 100000
+)
+
+var (
+	cgroupSliceOnce sync.Once
+	cgroupSlice     string // Parent of per-execution cgroups, once set up
+	cgroupSliceErr  error
+)
+
+// cgroupControllers are the controllers per-execution cgroups need
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// ownCgroup returns the path of the agent's cgroup under CgroupRoot
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The cgroup v2 entry is "0::<path>"
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(CgroupRoot, path), nil
+		}
+	}
+	return "", fmt.Errorf("agent is not in a cgroup v2 hierarchy")
+}
+
+// ensureCgroupSlice sets up the parent of per-execution cgroups and enables
+// the controllers for them (once per agent process).
+//
+// Under systemd, the agent's unit has Delegate=yes, so the agent owns the
+// subtree below its own cgroup and must not touch anything above it. As
+// cgroup v2 allows processes only in leaves of a cgroup with controllers
+// enabled for its children, the agent first moves itself (and anything it
+// already started) into a leaf of its own; executions become its siblings.
+func ensureCgroupSlice() error {
+	cgroupSliceOnce.Do(func() {
+		if _, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers")); err != nil {
+			cgroupSliceErr = fmt.Errorf("cgroup v2 is not available at %s", CgroupRoot)
+			return
+		}
+		own, err := ownCgroup()
+		if err != nil {
+			cgroupSliceErr = err
+			return
+		}
+
+		enable := "+" + strings.Join(cgroupControllers, " +")
+		if own == CgroupRoot {
+			// The root cgroup is exempt from the leaf rule
+			if err := os.WriteFile(filepath.Join(CgroupRoot, "cgroup.subtree_control"), []byte(enable), 0644); err != nil {
+				cgroupSliceErr = fmt.Errorf("failed to enable cgroup controllers: %w", err)
+				return
+			}
+			if err := os.MkdirAll(CgroupRootSlice, 0755); err != nil {
+				cgroupSliceErr = err
+				return
+			}
+			own = CgroupRootSlice
+		} else if err := moveToAgentLeaf(own); err != nil {
+			cgroupSliceErr = err
+			return
+		}
+
+		if err := os.WriteFile(filepath.Join(own, "cgroup.subtree_control"), []byte(enable), 0644); err != nil {
+			cgroupSliceErr = fmt.Errorf("failed to enable cgroup controllers in %s (is the agent's unit delegated?): %w", own, err)
+			return
+		}
+		cgroupSlice = own
+	})
+	return cgroupSliceErr
+}
+
+// moveToAgentLeaf moves every process in the agent's cgroup into a child
+// leaf, so controllers can be enabled for the cgroup's children
+func moveToAgentLeaf(own string) error {
+	leaf := filepath.Join(own, cgroupAgentLeaf)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create agent cgroup: %w", err)
+	}
+
+	// Repeat in case a process forked while the others were being moved
+	for i := 0; i < 10; i++ {
+		data, err := os.ReadFile(filepath.Join(own, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+		pids := strings.Fields(string(data))
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+			// A process may exit before it is moved
+			if err != nil && !errors.Is(err, syscall.ESRCH) {
+				return fmt.Errorf("failed to move process %s into %s: %w", pid, leaf, err)
+			}
+		}
+	}
+	return fmt.Errorf("processes keep appearing in %s", own)
+}
+
+// cgroupLeaf is the cgroup a single execution runs in
+type cgroupLeaf struct {
+	path string
+	dir  *os.File // Open directory, passed to clone3 to start the command inside
+}
+
+// needsCgroup reports whether any limit requires a cgroup
+func (l *ResourceLimits) needsCgroup() bool {
+	return l.MemoryMaxBytes > 0 || l.CPUQuotaPercent > 0 || l.PidsMax > 0
+}
+
+// rlimits returns the rlimits to apply in the exec helper
+func (l *ResourceLimits) rlimits() []helperRlimit {
+	var rlimits []helperRlimit
+	if l.NoFile != nil {
+		rlimits = append(rlimits, helperRlimit{Resource: syscall.RLIMIT_NOFILE, Limit: *l.NoFile})
+	}
+	if l.FileSize != nil {
+		rlimits = append(rlimits, helperRlimit{Resource: syscall.RLIMIT_FSIZE, Limit: *l.FileSize})
+	}
+	if l.Core != nil {
+		rlimits = append(rlimits, helperRlimit{Resource: syscall.RLIMIT_CORE, Limit: *l.Core})
+	}
+	return rlimits
+}
+
+// newCgroupLeaf creates a cgroup for an execution and applies the limits
+func newCgroupLeaf(id string, limits *ResourceLimits) (*cgroupLeaf, error) {
+	if err := ensureCgroupSlice(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(cgroupSlice, id)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	c := &cgroupLeaf{path: path}
+
+	settings := map[string]string{}
+	if limits.MemoryMaxBytes > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMaxBytes, 10)
+		// Without this the limit can be dodged by swapping
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.CPUQuotaPercent > 0 {
+		quota := limits.CPUQuotaPercent * cpuMaxPeriod / 100
+		settings["cpu.max"] = fmt.Sprintf("%d %d", quota, cpuMaxPeriod)
+	}
+	if limits.PidsMax > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.PidsMax)
+	}
+
+	for file, value := range settings {
+		err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+		if err != nil && !(file == "memory.swap.max" && os.IsNotExist(err)) {
+			c.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	c.dir = dir
+	return c, nil
+}
+
+// readEvents parses a flat-keyed cgroup events file such as memory.events
+func (c *cgroupLeaf) readEvents(file string) map[string]int64 {
+	f, err := os.Open(filepath.Join(c.path, file))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	events := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			events[fields[0]] = n
+		}
+	}
+	return events
+}
+
+// oomKilled reports whether the OOM killer killed a process in the cgroup
+func (c *cgroupLeaf) oomKilled() bool {
+	return c.readEvents("memory.events")["oom_kill"] > 0
+}
+
+// pidsLimited reports whether a fork failed because of pids.max
+func (c *cgroupLeaf) pidsLimited() bool {
+	return c.readEvents("pids.events")["max"] > 0
+}
+
+// remove kills anything still running in the cgroup and deletes it
+func (c *cgroupLeaf) remove() {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+
+	for i := 0; i < 10; i++ {
+		err := os.Remove(c.path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		// Processes left behind by the command keep the cgroup busy
+		os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Printf("[Otus Agent] Failed to remove cgroup %s\n", c.path)
+}
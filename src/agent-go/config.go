@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// AgentConfigPath is where the agent reads its optional configuration file
+const AgentConfigPath = "/etc/otus/agent.json"
+
+// agentConfig holds the settings of the agent configuration file.
+// A missing file or field keeps the default.
+type agentConfig struct {
+	// Executions (execute and execute_stream) allowed to run at once; more
+	// are queued by priority. Default: the number of CPUs, at least 2.
+	MaxConcurrentExecutions int `json:"maxConcurrentExecutions,omitempty"`
+
+	// Execution profiles by name, added to (or replacing) the built-in ci and hermetic
+	Profiles map[string]*executionProfile `json:"profiles,omitempty"`
+}
+
+// loadAgentConfig reads the configuration file at path. Errors are logged and
+// the defaults used, so a bad file cannot keep the agent from starting.
+func loadAgentConfig(path string) *agentConfig {
+	cfg := &agentConfig{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("[Otus Agent] Failed to read config %s: %v\n", path, err)
+		}
+		return cfg
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		fmt.Printf("[Otus Agent] Invalid config %s: %v\n", path, err)
+		return &agentConfig{}
+	}
+	for name, p := range cfg.Profiles {
+		if p == nil {
+			fmt.Printf("[Otus Agent] Ignoring empty profile %s in config %s\n", name, path)
+			delete(cfg.Profiles, name)
+		}
+	}
+	return cfg
+}
+
+// maxConcurrentExecutions returns the configured limit or the default
+func (c *agentConfig) maxConcurrentExecutions() int {
+	if c.MaxConcurrentExecutions > 0 {
+		return c.MaxConcurrentExecutions
+	}
+	return max(runtime.NumCPU(), 2)
+}
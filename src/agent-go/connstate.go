@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// connStateKey is the context key for the state of a vsock connection
+type connStateKey struct{}
+
+// connState holds the working directory and environment a connection has set
+// with chdir/set_env/unset_env. They are the defaults for later execute,
+// start_session and file calls on the same connection.
+type connState struct {
+	mu    sync.Mutex
+	cwd   string
+	env   map[string]string
+	unset map[string]bool // Inherited variables removed with unset_env
+}
+
+// newConnState creates the state for a new connection
+func newConnState() *connState {
+	return &connState{
+		cwd:   DefaultCwd,
+		env:   make(map[string]string),
+		unset: make(map[string]bool),
+	}
+}
+
+// withConnState attaches a connection's state to its context
+func withConnState(ctx context.Context, st *connState) context.Context {
+	return context.WithValue(ctx, connStateKey{}, st)
+}
+
+// connStateFrom returns the connection state in ctx. Without one (e.g. for
+// background work) it returns fresh state, so callers need not check.
+func connStateFrom(ctx context.Context) *connState {
+	if st, ok := ctx.Value(connStateKey{}).(*connState); ok {
+		return st
+	}
+	return newConnState()
+}
+
+// resolve makes a path absolute relative to the connection's working directory
+func (st *connState) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return filepath.Join(st.cwd, path)
+}
+
+// resolveDir is resolve for directory params, which default to the working directory
+func (st *connState) resolveDir(path string) string {
+	if path == "" {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.cwd
+	}
+	return st.resolve(path)
+}
+
+// applyToExecute fills in the connection's defaults where params don't override them
+func (st *connState) applyToExecute(params *ExecuteParams) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if params.Cwd == "" {
+		params.Cwd = st.cwd
+	} else if !filepath.IsAbs(params.Cwd) {
+		params.Cwd = filepath.Join(st.cwd, params.Cwd)
+	}
+
+	env := make(map[string]string, len(st.env)+len(params.Env))
+	for k, v := range st.env {
+		env[k] = v
+	}
+	for k, v := range params.Env {
+		env[k] = v
+	}
+	params.Env = env
+
+	for k := range st.unset {
+		if _, ok := env[k]; !ok {
+			params.UnsetEnv = append(params.UnsetEnv, k)
+		}
+	}
+}
+
+// applyToSession fills in the connection's defaults for a tmux session
+func (st *connState) applyToSession(params *StartSessionParams) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if params.Cwd == "" {
+		params.Cwd = st.cwd
+	} else if !filepath.IsAbs(params.Cwd) {
+		params.Cwd = filepath.Join(st.cwd, params.Cwd)
+	}
+
+	env := make(map[string]string, len(st.env)+len(params.Env))
+	for k, v := range st.env {
+		env[k] = v
+	}
+	for k, v := range params.Env {
+		env[k] = v
+	}
+	params.Env = env
+
+	for k := range st.unset {
+		if _, ok := env[k]; !ok {
+			params.UnsetEnv = append(params.UnsetEnv, k)
+		}
+	}
+}
+
+// snapshot returns the current state for get_context and friends
+func (st *connState) snapshot() *ConnContextResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	env := make(map[string]string, len(st.env))
+	for k, v := range st.env {
+		env[k] = v
+	}
+	unset := make([]string, 0, len(st.unset))
+	for k := range st.unset {
+		unset = append(unset, k)
+	}
+	sort.Strings(unset)
+
+	return &ConnContextResult{Cwd: st.cwd, Env: env, Unset: unset}
+}
+
+// ========== Connection context handlers ==========
+
+// validEnvName checks that a variable name can be put in an environment
+func validEnvName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty variable name")
+	}
+	// "A=B" would set A instead, and NUL cannot be passed to exec
+	if strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("invalid variable name: %q", name)
+	}
+	return nil
+}
+
+// handleSetEnv adds variables to the connection's default environment
+func (s *Server) handleSetEnv(st *connState, params *SetEnvParams) (*ConnContextResult, error) {
+	// Check everything first, so a bad variable leaves the state unchanged
+	for k, v := range params.Env {
+		if err := validEnvName(k); err != nil {
+			return nil, err
+		}
+		if strings.ContainsRune(v, 0) {
+			return nil, fmt.Errorf("value of %s contains NUL", k)
+		}
+	}
+
+	st.mu.Lock()
+	for k, v := range params.Env {
+		st.env[k] = v
+		delete(st.unset, k)
+	}
+	st.mu.Unlock()
+
+	return st.snapshot(), nil
+}
+
+// handleUnsetEnv removes variables from the connection's default environment,
+// including ones inherited from the agent
+func (s *Server) handleUnsetEnv(st *connState, params *UnsetEnvParams) (*ConnContextResult, error) {
+	for _, k := range params.Keys {
+		if err := validEnvName(k); err != nil {
+			return nil, err
+		}
+	}
+
+	st.mu.Lock()
+	for _, k := range params.Keys {
+		delete(st.env, k)
+		st.unset[k] = true
+	}
+	st.mu.Unlock()
+
+	return st.snapshot(), nil
+}
+
+// handleChdir changes the connection's default working directory
+func (s *Server) handleChdir(st *connState, params *ChdirParams) (*ConnContextResult, error) {
+	if params.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Clean(st.resolve(params.Path))
+	err = withUserFS(cred, func() error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("not a directory: %s", path)
+		}
+		// Stat only needs search permission on the parents; entering the
+		// directory needs it on the directory itself
+		_, err = os.Stat(path + "/.")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	st.cwd = path
+	st.mu.Unlock()
+
+	return st.snapshot(), nil
+}
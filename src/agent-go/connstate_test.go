@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestApplyToSession(t *testing.T) {
+	s := NewServer()
+	st := newConnState()
+	st.cwd = "/srv"
+	if _, err := s.handleSetEnv(st, &SetEnvParams{Env: map[string]string{"A": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.handleUnsetEnv(st, &UnsetEnvParams{Keys: []string{"HOME", "LANG"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A variable given for the session wins over the connection's unset_env
+	params := &StartSessionParams{Name: "s", Cwd: "app", Env: map[string]string{"LANG": "C"}}
+	st.applyToSession(params)
+
+	if params.Cwd != "/srv/app" {
+		t.Errorf("cwd = %q, want /srv/app", params.Cwd)
+	}
+	if params.Env["A"] != "1" || params.Env["LANG"] != "C" {
+		t.Errorf("env = %v, want A=1 and LANG=C", params.Env)
+	}
+	if !slices.Equal(params.UnsetEnv, []string{"HOME"}) {
+		t.Errorf("unsetEnv = %v, want [HOME]", params.UnsetEnv)
+	}
+}
+
+func TestResolveDir(t *testing.T) {
+	st := newConnState()
+	st.cwd = "/srv"
+
+	tests := []struct{ path, want string }{
+		{"", "/srv"},
+		{"app", "/srv/app"},
+		{"/tmp", "/tmp"},
+	}
+	for _, tt := range tests {
+		if got := st.resolveDir(tt.path); got != tt.want {
+			t.Errorf("resolveDir(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"golang.org/x/sys/unix"
+)
+
+// Output stream names used in results and notifications
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// execution tracks a single command run by the agent
+type execution struct {
+	id          string
+	cmd         *exec.Cmd
+	timeout     time.Duration
+	idleTimeout time.Duration // Stop the command after this long without output
+	gracePeriod time.Duration // Time between SIGTERM and SIGKILL
+	startTime   time.Time
+	startMono   time.Duration // Monotonic clock at start, to find kernel log records since
+	command     string        // For display in the execution history
+	envKeys     []string      // Variables set by the request (values are not kept)
+	limited     bool          // Waits for a slot in the server's queue before starting
+	priority    int
+	queuedMs    int64
+
+	// conn and requestID identify the request that started the execution, so
+	// the host can cancel a plain execute before it knows the execution ID
+	conn      *jsonrpc2.Conn
+	requestID string
+
+	cancelOnce sync.Once
+	cancelCh   chan struct{} // Closed when the host asks to cancel
+	started    chan struct{} // Closed once the command has been started (or failed to)
+	done       chan struct{} // Closed once res is set
+	res        *ExecuteResult
+
+	mu sync.Mutex
+	// capture controls whether output is buffered for the final result
+	capture bool
+	stdout  *outputCapture
+	stderr  *outputCapture
+	// onOutput is called (under mu) for every chunk of output, in order
+	onOutput   func(stream string, data []byte)
+	lastOutput time.Time // When output last arrived, for the idle timeout
+	recent     []byte    // The end of the output, to look for a prompt in
+
+	// closers are released once the command has finished
+	closers []io.Closer
+
+	// In PTY mode the command's stdio is the slave side of ptyMaster and
+	// its merged output is read from the master as stdout
+	ptyMaster *os.File
+	ptySlave  *os.File
+	ptyInput  io.Reader // Written to the terminal once the command has started
+	stripANSI bool
+	inputs    []string // Files a prompt would be read from; set to stop early when one is
+
+	chunks       *chunkLog // Set when interleaved output was requested
+	omitSeparate bool      // Leave Stdout and Stderr out of the result
+	encoding     string    // Requested output encoding
+
+	// cgroup is set when the command runs under cgroup resource limits
+	cgroup *cgroupLeaf
+}
+
+// outputWriter feeds one output stream of a command into its execution
+type outputWriter struct {
+	e      *execution
+	stream string
+}
+
+// Write records a chunk of output for the stream
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.e.write(w.stream, p)
+	return len(p), nil
+}
+
+// newExecution validates params and prepares the command without starting it
+func (s *Server) newExecution(params *ExecuteParams) (*execution, error) {
+	cwd := params.Cwd
+	if cwd == "" {
+		cwd = DefaultCwd
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	gracePeriodMs := params.GracePeriodMs
+	if gracePeriodMs <= 0 {
+		gracePeriodMs = DefaultGracePeriodMs
+	}
+
+	maxStdout := params.MaxStdoutBytes
+	if maxStdout <= 0 {
+		maxStdout = DefaultMaxOutputBytes
+	}
+	maxStderr := params.MaxStderrBytes
+	if maxStderr <= 0 {
+		maxStderr = DefaultMaxOutputBytes
+	}
+
+	args, script, err := commandArgs(params)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = environWithout(params.UnsetEnv)
+
+	var profile *executionProfile
+	if params.Profile != "" {
+		if profile, err = s.profile(params.Profile); err != nil {
+			return nil, err
+		}
+		for k, v := range profile.Env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
+	var cred *userCred
+	if params.User != "" {
+		cred, err = lookupUser(params.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, cred.env()...)
+	}
+
+	for k, v := range params.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if params.Stdin != "" && params.StdinFile != "" {
+		return nil, fmt.Errorf("stdin and stdinFile are mutually exclusive")
+	}
+
+	// Without stdin the command reads from /dev/null. A reader is closed by
+	// exec once it is exhausted, so the command sees EOF.
+	var stdin io.Reader
+	var closers []io.Closer
+	if params.Stdin != "" {
+		input, err := base64.StdEncoding.DecodeString(params.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 stdin: %w", err)
+		}
+		stdin = bytes.NewReader(input)
+	} else if params.StdinFile != "" {
+		path := params.StdinFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cwd, path)
+		}
+		// Opened with the user's permissions, so stdin can't reveal files the command couldn't read
+		var f *os.File
+		err := withUserFS(cred, func() error {
+			var err error
+			f, err = os.Open(path)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stdin file: %w", err)
+		}
+		stdin = f
+		closers = append(closers, f)
+	}
+
+	if script != nil {
+		// The interpreter reads the script from /dev/fd/3
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		// Opening /dev/fd/3 checks the pipe's owner, so it must be the user's
+		if cred != nil {
+			if err := unix.Fchown(int(r.Fd()), int(cred.uid), int(cred.gid)); err != nil {
+				r.Close()
+				w.Close()
+				return nil, fmt.Errorf("failed to hand the script pipe to the user: %w", err)
+			}
+		}
+		cmd.ExtraFiles = []*os.File{r}
+		closers = append(closers, r)
+		go func() {
+			w.Write(script)
+			w.Close()
+		}()
+	}
+
+	// Run in a new session (and so a new process group) so the whole tree
+	// can be signalled on timeout or cancel, not just bash
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if cred != nil {
+		cmd.SysProcAttr.Credential = cred.credential()
+	}
+	// Don't let processes that escaped the group keep Wait blocked on the pipes
+	cmd.WaitDelay = OutputWaitDelay
+
+	id := s.nextExecutionID()
+	e := &execution{
+		id:          id,
+		cmd:         cmd,
+		timeout:     time.Duration(timeout) * time.Second,
+		idleTimeout: time.Duration(params.IdleTimeout) * time.Second,
+		gracePeriod: time.Duration(gracePeriodMs) * time.Millisecond,
+		cancelCh:    make(chan struct{}),
+		started:     make(chan struct{}),
+		done:        make(chan struct{}),
+		capture:     true,
+		stdout:      newOutputCapture(maxStdout, spillPath(id, StreamStdout)),
+		stderr:      newOutputCapture(maxStderr, spillPath(id, StreamStderr)),
+		closers:     closers,
+		command:     displayCommand(params),
+		envKeys:     sortedKeys(params.Env),
+		priority:    params.Priority,
+	}
+
+	if params.PTY {
+		rows, cols := params.Rows, params.Cols
+		if rows <= 0 {
+			rows = DefaultPTYRows
+		}
+		if cols <= 0 {
+			cols = DefaultPTYCols
+		}
+
+		master, slave, err := openPTY(rows, cols)
+		if err != nil {
+			e.release()
+			return nil, fmt.Errorf("failed to allocate pty: %w", err)
+		}
+
+		// The terminal becomes the controlling terminal of the new session
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+
+		e.ptyMaster = master
+		e.ptySlave = slave
+		e.ptyInput = stdin
+		e.stripANSI = params.StripANSI
+		// Programs that prompt read the terminal, either as stdin or through /dev/tty
+		if !params.AllowInputWait {
+			e.inputs = []string{slave.Name(), "/dev/tty"}
+		}
+		e.closers = append(e.closers, master)
+	} else {
+		cmd.Stdin = stdin
+		cmd.Stdout = &outputWriter{e: e, stream: StreamStdout}
+		cmd.Stderr = &outputWriter{e: e, stream: StreamStderr}
+	}
+
+	switch params.Output {
+	case "", OutputSeparate:
+	case OutputInterleaved, OutputBoth:
+		e.chunks = &chunkLog{limit: maxStdout + maxStderr}
+		e.omitSeparate = params.Output == OutputInterleaved
+	default:
+		e.release()
+		return nil, fmt.Errorf("invalid output format: %s", params.Output)
+	}
+
+	switch params.Encoding {
+	case "", EncodingAuto, EncodingUTF8, EncodingBase64:
+		e.encoding = params.Encoding
+	default:
+		e.release()
+		return nil, fmt.Errorf("invalid output encoding: %s", params.Encoding)
+	}
+
+	var helper helperSpec
+	switch params.Network {
+	case "", NetworkDefault:
+	case NetworkNone, NetworkLoopback:
+		// A fresh network namespace has only lo, which starts out down
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		helper.LoopbackUp = params.Network == NetworkLoopback
+	default:
+		e.release()
+		return nil, fmt.Errorf("invalid network mode: %s", params.Network)
+	}
+
+	if profile != nil {
+		if helper.Umask, err = profile.umask(); err != nil {
+			e.release()
+			return nil, err
+		}
+	}
+
+	if params.Limits != nil {
+		helper.Rlimits = params.Limits.rlimits()
+
+		if params.Limits.needsCgroup() {
+			cg, err := newCgroupLeaf(id, params.Limits)
+			if err != nil {
+				e.release()
+				return nil, err
+			}
+			// Start the command directly inside its cgroup (clone3), so even
+			// its first fork is accounted
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+			e.cgroup = cg
+		}
+	}
+	if !helper.empty() {
+		// Switching user at fork would leave the helper without the
+		// privileges its setup needs, so it switches after setup instead
+		helper.Credential = cmd.SysProcAttr.Credential
+		cmd.SysProcAttr.Credential = nil
+
+		if err := wrapWithHelper(cmd, &helper); err != nil {
+			e.release()
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// scriptFlags maps known interpreters to the flag that takes a script inline
+var scriptFlags = map[string]string{
+	"sh":      "-c",
+	"bash":    "-c",
+	"python":  "-c",
+	"python3": "-c",
+	"node":    "-e",
+	"perl":    "-e",
+	"ruby":    "-e",
+}
+
+// commandArgs returns the argv to run for params. The command is either an
+// explicit argv, executed without a shell, or a base64-encoded script run by
+// an interpreter (bash by default). Interpreters without a known inline-script
+// flag get the script as /dev/fd/3, which is then returned to be fed to it.
+func commandArgs(params *ExecuteParams) (args []string, script []byte, err error) {
+	if len(params.Argv) > 0 {
+		if params.Command != "" || params.Interpreter != "" {
+			return nil, nil, fmt.Errorf("argv cannot be combined with command or interpreter")
+		}
+		return params.Argv, nil, nil
+	}
+
+	// Decode command from base64 (all commands are base64-encoded)
+	if params.Command == "" {
+		return nil, nil, fmt.Errorf("no command provided")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(params.Command)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode base64 command: %w", err)
+	}
+
+	// Use bash instead of sh for better compatibility (source, arrays, etc.)
+	interpreter := params.Interpreter
+	if interpreter == "" {
+		interpreter = "bash"
+	}
+
+	if flag, ok := scriptFlags[filepath.Base(interpreter)]; ok {
+		return []string{interpreter, flag, string(decoded)}, nil, nil
+	}
+	return []string{interpreter, "/dev/fd/3"}, decoded, nil
+}
+
+// environWithout returns the agent's environment minus the given variables
+func environWithout(keys []string) []string {
+	env := os.Environ()
+	if len(keys) == 0 {
+		return env
+	}
+
+	drop := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		drop[k] = true
+	}
+	kept := env[:0]
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !drop[name] {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// sortedKeys returns the keys of an environment map in order
+func sortedKeys(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// displayCommand returns a human-readable form of the command in params
+func displayCommand(params *ExecuteParams) string {
+	if len(params.Argv) > 0 {
+		return strings.Join(params.Argv, " ")
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(params.Command)
+	return string(decoded)
+}
+
+// write appends output to the capture buffers and forwards it to onOutput
+func (e *execution) write(stream string, p []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastOutput = time.Now()
+	e.recent = append(e.recent, p...)
+	if len(e.recent) > promptTailBytes {
+		e.recent = append([]byte(nil), e.recent[len(e.recent)-promptTailBytes:]...)
+	}
+
+	if e.capture {
+		if stream == StreamStderr {
+			e.stderr.Write(p)
+		} else {
+			e.stdout.Write(p)
+		}
+		if e.chunks != nil {
+			e.chunks.add(stream, time.Since(e.startTime).Milliseconds(), p)
+		}
+	}
+	if e.onOutput != nil {
+		e.onOutput(stream, p)
+	}
+}
+
+// runExecution runs e while it is registered as in-flight, so it can be found by cancel
+func (s *Server) runExecution(ctx context.Context, e *execution) *ExecuteResult {
+	s.mu.Lock()
+	s.executions[e.id] = e
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.executions, e.id)
+		s.mu.Unlock()
+	}()
+
+	if e.limited {
+		queued, ok := s.queue.acquire(ctx, e.cancelCh, e.priority)
+		e.queuedMs = queued.Milliseconds()
+		if !ok {
+			res := e.skip()
+			s.recordExecution(e)
+			return res
+		}
+		defer s.queue.release()
+	}
+
+	res := e.run(ctx)
+	s.recordExecution(e)
+	if res.OutputID != "" {
+		s.trackOutput(res.OutputID)
+	}
+	return res
+}
+
+// findExecution looks up an in-flight execution by execution ID, or by the
+// JSON-RPC request ID it was started with on the given connection
+func (s *Server) findExecution(conn *jsonrpc2.Conn, executionID string, requestID *jsonrpc2.ID) *execution {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if executionID != "" {
+		return s.executions[executionID]
+	}
+	if requestID != nil {
+		for _, e := range s.executions {
+			if e.conn == conn && e.requestID == requestID.String() {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// cancel asks a running execution to stop; it is safe to call more than once
+func (e *execution) cancel() {
+	e.cancelOnce.Do(func() { close(e.cancelCh) })
+}
+
+// wait blocks until the execution has finished and returns its result
+func (e *execution) wait() *ExecuteResult {
+	<-e.done
+	return e.res
+}
+
+// finished returns the result if the execution has finished, or nil if it is still running
+func (e *execution) finished() *ExecuteResult {
+	select {
+	case <-e.done:
+		return e.res
+	default:
+		return nil
+	}
+}
+
+// skip finishes an execution that was cancelled before it could start
+func (e *execution) skip() *ExecuteResult {
+	e.startTime = time.Now()
+	e.release()
+	e.res = &ExecuteResult{
+		ExecutionID: e.id,
+		ExitCode:    -1,
+		QueuedMs:    e.queuedMs,
+		Cancelled:   true,
+	}
+	encodeOutput(e.res, e.encoding)
+	close(e.started)
+	close(e.done)
+	return e.res
+}
+
+// idleFor returns how long the command has gone without output
+func (e *execution) idleFor() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Since(e.lastOutput)
+}
+
+// waitingForInput returns the prompt if the command has gone quiet after
+// printing one and is blocked reading its terminal, or "" otherwise
+func (e *execution) waitingForInput() string {
+	if e.idleFor() < InputWaitDelay {
+		return ""
+	}
+	e.mu.Lock()
+	prompt := promptTail(e.recent)
+	e.mu.Unlock()
+
+	if prompt == "" || !blockedOnInput(e.cmd.Process.Pid, e.inputs) {
+		return ""
+	}
+	return prompt
+}
+
+// run starts the command and waits for it to finish, time out or be cancelled
+// (either through ctx or cancel). The result is also made available to wait.
+// A zero timeout lets the command run until it exits.
+func (e *execution) run(ctx context.Context) *ExecuteResult {
+	e.startTime = time.Now()
+	e.startMono = monotonicNow()
+	e.mu.Lock()
+	e.lastOutput = e.startTime
+	e.mu.Unlock()
+	defer close(e.done)
+	defer e.release()
+
+	err := e.cmd.Start()
+	close(e.started)
+	if e.ptySlave != nil {
+		// Only the command keeps the terminal open, so reads from the master
+		// end once it (and anything it left running) has exited
+		e.ptySlave.Close()
+	}
+	if err != nil {
+		e.res = &ExecuteResult{
+			ExecutionID: e.id,
+			Stdout:      "",
+			Stderr:      err.Error(),
+			ExitCode:    -1,
+			QueuedMs:    e.queuedMs,
+			StartError:  err.Error(),
+			DurationMs:  time.Since(e.startTime).Milliseconds(),
+		}
+		return e.res
+	}
+
+	ptyDone := e.startPTY()
+
+	done := make(chan error, 1)
+	go func() {
+		err := e.cmd.Wait()
+		if ptyDone != nil {
+			e.waitPTY(ptyDone)
+		}
+		done <- err
+	}()
+
+	var timeoutCh <-chan time.Time
+	if e.timeout > 0 {
+		timer := time.NewTimer(e.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	// Rather than being reset on every write, the idle timer is re-armed
+	// for the remaining time when it fires after more output has arrived
+	var idleTimer *time.Timer
+	var idleCh <-chan time.Time
+	if e.idleTimeout > 0 {
+		idleTimer = time.NewTimer(e.idleTimeout)
+		defer idleTimer.Stop()
+		idleCh = idleTimer.C
+	}
+
+	var inputCh <-chan time.Time
+	if len(e.inputs) > 0 {
+		ticker := time.NewTicker(InputCheckInterval)
+		defer ticker.Stop()
+		inputCh = ticker.C
+	}
+
+	var timedOut, idleTimedOut, cancelled bool
+	var prompt string
+wait:
+	for {
+		select {
+		case <-done:
+			e.res = e.result(e.exitCode())
+			return e.res
+
+		case <-timeoutCh:
+			timedOut = true
+		case <-idleCh:
+			if idle := e.idleFor(); idle < e.idleTimeout {
+				idleTimer.Reset(e.idleTimeout - idle)
+				continue
+			}
+			idleTimedOut = true
+		case <-inputCh:
+			if prompt = e.waitingForInput(); prompt == "" {
+				continue
+			}
+		case <-ctx.Done():
+			cancelled = true
+		case <-e.cancelCh:
+			cancelled = true
+		}
+		break wait
+	}
+
+	killed := e.terminate()
+	<-done
+
+	e.res = e.result(-1)
+	e.res.TimedOut = timedOut
+	e.res.IdleTimedOut = idleTimedOut
+	e.res.WaitingForInput = prompt != ""
+	e.res.Prompt = prompt
+	e.res.Cancelled = cancelled
+	e.res.KilledPids = killed
+	return e.res
+}
+
+// startPTY copies terminal output into the execution and feeds it any stdin.
+// The returned channel is closed when the output has been drained, or nil if
+// the command is not running on a PTY.
+func (e *execution) startPTY() chan struct{} {
+	if e.ptyMaster == nil {
+		return nil
+	}
+
+	if e.ptyInput != nil {
+		go io.Copy(e.ptyMaster, e.ptyInput)
+	}
+
+	ptyDone := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once no process has the terminal open
+		io.Copy(&outputWriter{e: e, stream: StreamStdout}, e.ptyMaster)
+		close(ptyDone)
+	}()
+	return ptyDone
+}
+
+// waitPTY waits for terminal output to be drained after the command has
+// exited, closing the master early if a leftover process keeps it open
+func (e *execution) waitPTY(ptyDone chan struct{}) {
+	select {
+	case <-ptyDone:
+	case <-time.After(OutputWaitDelay):
+		e.ptyMaster.Close()
+		<-ptyDone
+	}
+}
+
+// release closes resources held for the command, such as a stdin file
+func (e *execution) release() {
+	for _, c := range e.closers {
+		c.Close()
+	}
+	if e.cgroup != nil {
+		e.cgroup.remove()
+	}
+}
+
+// terminate stops the command's whole process group, returning the PIDs
+// that did not exit within the grace period and had to be SIGKILLed
+func (e *execution) terminate() []int {
+	if e.cmd.Process == nil {
+		return nil
+	}
+	// With Setsid the process group ID is the leader's PID
+	return killProcessGroup(e.cmd.Process.Pid, e.gracePeriod)
+}
+
+// exitCode returns the exit code of a finished command, or -1 if it did not exit normally
+func (e *execution) exitCode() int {
+	if e.cmd.ProcessState == nil {
+		return -1
+	}
+	return e.cmd.ProcessState.ExitCode()
+}
+
+// usage converts the rusage of a finished command. The kernel folds in the usage
+// of every descendant that was waited for, so this covers the whole tree.
+func (e *execution) usage() *ResourceUsage {
+	if e.cmd.ProcessState == nil {
+		return nil
+	}
+	ru, ok := e.cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return nil
+	}
+
+	return &ResourceUsage{
+		UserCPUMs:              time.Duration(ru.Utime.Nano()).Milliseconds(),
+		SystemCPUMs:            time.Duration(ru.Stime.Nano()).Milliseconds(),
+		MaxRSSKb:               ru.Maxrss, // Already in kilobytes on Linux
+		BlockInputOps:          ru.Inblock,
+		BlockOutputOps:         ru.Oublock,
+		VoluntaryCtxSwitches:   ru.Nvcsw,
+		InvoluntaryCtxSwitches: ru.Nivcsw,
+	}
+}
+
+// oomKilledByKernel checks the kernel log for an OOM kill of a command that
+// has no cgroup to report it. Only SIGKILLed commands are checked: either the
+// command itself was the victim, or it is a shell reporting a child killed by
+// SIGKILL (exit code 137), in which case any OOM kill during its run counts.
+func (e *execution) oomKilledByKernel() bool {
+	state := e.cmd.ProcessState
+	if state == nil {
+		return false
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	leaderKilled := ws.Signaled() && ws.Signal() == syscall.SIGKILL
+	childKilled := ws.Exited() && ws.ExitStatus() == 128+int(syscall.SIGKILL)
+	if !leaderKilled && !childKilled {
+		return false
+	}
+
+	for _, pid := range kmsgOOMKills(e.startMono) {
+		if childKilled || pid == state.Pid() {
+			return true
+		}
+	}
+	return false
+}
+
+// result builds an ExecuteResult from the captured output
+func (e *execution) result(exitCode int) *ExecuteResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	res := &ExecuteResult{
+		ExecutionID: e.id,
+		ExitCode:    exitCode,
+		DurationMs:  time.Since(e.startTime).Milliseconds(),
+		QueuedMs:    e.queuedMs,
+		Usage:       e.usage(),
+	}
+	if state := e.cmd.ProcessState; state != nil {
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.Signal = unix.SignalName(ws.Signal())
+			res.CoreDumped = ws.CoreDump()
+		}
+	}
+	if e.cgroup != nil {
+		res.OOMKilled = e.cgroup.oomKilled()
+		res.PidsLimitHit = e.cgroup.pidsLimited()
+	} else {
+		res.OOMKilled = e.oomKilledByKernel()
+	}
+	if !e.capture {
+		return res
+	}
+
+	e.stdout.close()
+	e.stderr.close()
+
+	res.Stdout = e.stdout.String()
+	res.Stderr = e.stderr.String()
+	if e.stripANSI {
+		res.Stdout = stripANSI(res.Stdout)
+	}
+	res.StdoutBytes = e.stdout.total
+	res.StderrBytes = e.stderr.total
+	res.StdoutTruncated = e.stdout.truncated
+	res.StderrTruncated = e.stderr.truncated
+	if e.stdout.spilled() || e.stderr.spilled() {
+		res.OutputID = e.id
+	}
+
+	if e.chunks != nil {
+		res.Chunks = e.chunks.chunks()
+		res.ChunksTruncated = e.chunks.truncated
+		if e.stripANSI {
+			for i := range res.Chunks {
+				res.Chunks[i].Data = stripANSI(res.Chunks[i].Data)
+			}
+		}
+		if e.omitSeparate {
+			res.Stdout, res.Stderr = "", ""
+		}
+	}
+
+	encodeOutput(res, e.encoding)
+	return res
+}
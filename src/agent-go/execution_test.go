@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain lets the test binary act as the exec helper, as the agent does
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		runExecHelper()
+	}
+	os.Exit(m.Run())
+}
+
+// runTestExecution runs a command through newExecution and runExecution
+func runTestExecution(t *testing.T, s *Server, params *ExecuteParams) *ExecuteResult {
+	t.Helper()
+	params.Command = base64.StdEncoding.EncodeToString([]byte(params.Command))
+	e, err := s.newExecution(params)
+	if err != nil {
+		t.Fatalf("newExecution: %v", err)
+	}
+	return s.runExecution(context.Background(), e)
+}
+
+// requireRoot skips tests that switch users when the agent can't
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+}
+
+func TestStdinFileRelative(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input"), []byte("from file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := runTestExecution(t, NewServer(), &ExecuteParams{Command: "cat", Cwd: dir, StdinFile: "input"})
+	if res.ExitCode != 0 || res.Stdout != "from file\n" {
+		t.Errorf("got exit code %d, stdout %q, stderr %q; want the file's contents", res.ExitCode, res.Stdout, res.Stderr)
+	}
+}
+
+func TestStdinFileAsUser(t *testing.T) {
+	requireRoot(t)
+	// The directories are open to the user, only the file is not
+	dir := t.TempDir()
+	os.Chmod(filepath.Dir(dir), 0755)
+	os.Chmod(dir, 0755)
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewServer().newExecution(&ExecuteParams{
+		Command:   base64.StdEncoding.EncodeToString([]byte("cat")),
+		Cwd:       dir,
+		User:      "nobody",
+		StdinFile: secret,
+	})
+	if err == nil {
+		e.release()
+		t.Fatal("a file the user cannot read was opened as stdin")
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("error = %v, want permission denied", err)
+	}
+}
+
+func TestScriptFileAsUser(t *testing.T) {
+	requireRoot(t)
+	if _, err := os.Stat("/bin/dash"); err != nil {
+		t.Skip("dash is not installed")
+	}
+
+	// dash has no entry in scriptFlags, so it reads the script from /dev/fd/3.
+	// A limit starts it through the exec helper, which switches user itself.
+	nofile := uint64(64)
+	for _, limits := range []*ResourceLimits{nil, {NoFile: &nofile}} {
+		res := runTestExecution(t, NewServer(), &ExecuteParams{Command: "id -u", Interpreter: "/bin/dash", Cwd: "/", User: "nobody", Limits: limits})
+		if res.ExitCode != 0 || res.Stdout != "65534\n" || res.Stderr != "" {
+			t.Errorf("limits %+v: got exit code %d, stdout %q, stderr %q; want nobody's uid", limits, res.ExitCode, res.Stdout, res.Stderr)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// expectSource is the output an expect call matches against and the input it sends to
+type expectSource interface {
+	// read returns the output that has arrived since the last call
+	read() (string, error)
+	// send writes text to the input; "\n" presses Enter
+	send(text string) error
+	// exited reports whether no more output can arrive
+	exited() bool
+	close()
+}
+
+// terminalFilter turns raw terminal output into matchable text, holding back
+// escape sequences and characters that are split across reads
+type terminalFilter struct {
+	strip   bool // Remove escape sequences (for PTY and tmux output)
+	pending []byte
+}
+
+// feed filters the next chunk of raw output
+func (f *terminalFilter) feed(data []byte) string {
+	data = append(f.pending, data...)
+	f.pending = nil
+
+	if f.strip {
+		// An escape sequence or CRLF cut off at the end is completed by the next read
+		if i := strings.LastIndexByte(string(data), 0x1b); i >= 0 && len(data)-i < 256 &&
+			strings.IndexByte(stripANSI(string(data[i:])), 0x1b) >= 0 {
+			f.pending = append(f.pending, data[i:]...)
+			data = data[:i]
+		} else if len(data) > 0 && data[len(data)-1] == '\r' {
+			f.pending = append(f.pending, '\r')
+			data = data[:len(data)-1]
+		}
+	}
+	data, partial := splitPartialRune(data)
+	f.pending = append(append([]byte(nil), partial...), f.pending...)
+
+	if f.strip {
+		return stripANSI(string(data))
+	}
+	return string(data)
+}
+
+// jobSource reads a background process's output log and writes to its stdin
+type jobSource struct {
+	j      *job
+	log    *os.File
+	offset int64 // Position in the log read up to
+	filter terminalFilter
+}
+
+func (src *jobSource) read() (string, error) {
+	buf := make([]byte, DefaultReadOutputLength)
+	var text strings.Builder
+	for {
+		n, err := src.log.ReadAt(buf, src.offset)
+		src.offset += int64(n)
+		text.WriteString(src.filter.feed(buf[:n]))
+		if err == io.EOF || n == 0 {
+			return text.String(), nil
+		}
+		if err != nil {
+			return text.String(), err
+		}
+	}
+}
+
+func (src *jobSource) send(text string) error {
+	if src.j.stdin == nil {
+		return fmt.Errorf("process %s has no open stdin (spawn it with openStdin or pty)", src.j.e.id)
+	}
+	_, err := io.WriteString(src.j.stdin, text)
+	return err
+}
+
+func (src *jobSource) exited() bool {
+	return src.j.e.finished() != nil
+}
+
+func (src *jobSource) close() {
+	src.log.Close()
+}
+
+// sessionSource follows a tmux session's output through pipe-pane and types into it
+type sessionSource struct {
+	name    string
+	path    string // File tmux pipes the pane's output to
+	log     *os.File
+	offset  int64
+	initial string // Pane contents when expect started, returned by the first read
+	filter  terminalFilter
+}
+
+// newSessionSource starts piping a session's output to a file
+func newSessionSource(name, id string) (*sessionSource, error) {
+	if err := exec.Command("tmux", "has-session", "-t", name).Run(); err != nil {
+		return nil, fmt.Errorf("session %s does not exist", name)
+	}
+	if err := os.MkdirAll(ExpectDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(ExpectDir, id)
+	log, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	src := &sessionSource{name: name, path: path, log: log, filter: terminalFilter{strip: true}}
+
+	// Start the pipe before capturing, so no output falls between the two
+	if output, err := exec.Command("tmux", "pipe-pane", "-t", name, "cat >> '"+path+"'").CombinedOutput(); err != nil {
+		src.close()
+		return nil, fmt.Errorf("failed to pipe session output: %v: %s", err, string(output))
+	}
+	if pane, err := exec.Command("tmux", "capture-pane", "-t", name, "-p").Output(); err == nil {
+		src.initial = strings.TrimRight(string(pane), " \n")
+	}
+	return src, nil
+}
+
+func (src *sessionSource) read() (string, error) {
+	text := src.initial
+	src.initial = ""
+
+	buf := make([]byte, DefaultReadOutputLength)
+	for {
+		n, err := src.log.ReadAt(buf, src.offset)
+		src.offset += int64(n)
+		text += src.filter.feed(buf[:n])
+		if err == io.EOF || n == 0 {
+			return text, nil
+		}
+		if err != nil {
+			return text, err
+		}
+	}
+}
+
+func (src *sessionSource) send(text string) error {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			if err := exec.Command("tmux", "send-keys", "-t", src.name, "Enter").Run(); err != nil {
+				return fmt.Errorf("failed to send keys: %w", err)
+			}
+		}
+		if line != "" {
+			if err := exec.Command("tmux", "send-keys", "-t", src.name, "-l", line).Run(); err != nil {
+				return fmt.Errorf("failed to send keys: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (src *sessionSource) exited() bool {
+	return exec.Command("tmux", "has-session", "-t", src.name).Run() != nil
+}
+
+func (src *sessionSource) close() {
+	// pipe-pane without a command stops the pipe
+	exec.Command("tmux", "pipe-pane", "-t", src.name).Run()
+	src.log.Close()
+	os.Remove(src.path)
+}
+
+// tailString returns at most the last n bytes of s, and whether it was cut
+func tailString(s string, n int) (string, bool) {
+	if len(s) <= n {
+		return s, false
+	}
+	return string(trimContinuationBytes([]byte(s[len(s)-n:]))), true
+}
+
+// ========== Expect handlers ==========
+
+// handleExpect runs a sequence of wait-for-pattern-then-send steps against a
+// tmux session or a background process. It stops at the first step whose
+// pattern does not appear within its timeout, or when the connection closes.
+func (s *Server) handleExpect(ctx context.Context, params *ExpectParams) (*ExpectResult, error) {
+	if (params.Session == "") == (params.ProcessID == "") {
+		return &ExpectResult{Success: false, Error: "exactly one of session and processId is required"}, nil
+	}
+
+	patterns := make([]*regexp.Regexp, len(params.Steps))
+	for i, step := range params.Steps {
+		if step.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(step.Pattern)
+		if err != nil {
+			return &ExpectResult{Success: false, Error: fmt.Sprintf("step %d: invalid pattern: %v", i+1, err)}, nil
+		}
+		patterns[i] = re
+	}
+
+	var src expectSource
+	var js *jobSource
+	if params.Session != "" {
+		ss, err := newSessionSource(params.Session, s.nextExecutionID())
+		if err != nil {
+			return &ExpectResult{Success: false, Error: err.Error()}, nil
+		}
+		src = ss
+	} else {
+		j, err := s.getJob(params.ProcessID)
+		if err != nil {
+			return &ExpectResult{Success: false, Error: err.Error()}, nil
+		}
+		stream := params.Stream
+		if stream == "" {
+			stream = StreamStdout
+		}
+		if stream != StreamStdout && stream != StreamStderr {
+			return &ExpectResult{Success: false, Error: fmt.Sprintf("invalid stream: %s", stream)}, nil
+		}
+		log, err := os.Open(jobOutputPath(j.e.id, stream))
+		if err != nil {
+			return nil, err
+		}
+		js = &jobSource{j: j, log: log, offset: params.Offset, filter: terminalFilter{strip: j.e.ptyMaster != nil}}
+		src = js
+	}
+	defer src.close()
+
+	result := &ExpectResult{Success: true, Steps: []ExpectStepResult{}}
+	var buf string // Output not yet consumed by a match
+	for i, step := range params.Steps {
+		var r ExpectStepResult
+		if re := patterns[i]; re != nil {
+			timeout := step.Timeout
+			if timeout <= 0 {
+				timeout = DefaultExpectTimeout
+			}
+			deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+			for {
+				// Check for exit first, so output written just before it is still read
+				exited := src.exited()
+				text, err := src.read()
+				buf += text
+				if err != nil {
+					result.Error = err.Error()
+				}
+
+				if loc := re.FindStringSubmatchIndex(buf); loc != nil {
+					r.Matched = true
+					r.Match = buf[loc[0]:loc[1]]
+					for g := 2; g < len(loc); g += 2 {
+						if loc[g] >= 0 {
+							r.Groups = append(r.Groups, buf[loc[g]:loc[g+1]])
+						} else {
+							r.Groups = append(r.Groups, "")
+						}
+					}
+					r.Output, r.OutputTruncated = tailString(buf[:loc[1]], MaxExpectOutputBytes)
+					buf = buf[loc[1]:]
+					break
+				}
+
+				// Don't let output that never matches grow without bound
+				if len(buf) > DefaultMaxOutputBytes {
+					buf = string(trimContinuationBytes([]byte(buf[len(buf)-DefaultMaxOutputBytes:])))
+				}
+
+				switch {
+				case result.Error != "":
+				case exited:
+					result.Error = fmt.Sprintf("step %d: exited before %q appeared", i+1, step.Pattern)
+				case time.Now().After(deadline):
+					r.TimedOut = true
+					result.Error = fmt.Sprintf("step %d: timed out after %ds waiting for %q", i+1, timeout, step.Pattern)
+				case ctx.Err() != nil:
+					result.Error = ctx.Err().Error()
+				default:
+					select {
+					case <-time.After(ExpectPollInterval):
+					case <-ctx.Done():
+					}
+					continue
+				}
+
+				r.Output, r.OutputTruncated = tailString(buf, MaxExpectOutputBytes)
+				result.Success = false
+				result.Steps = append(result.Steps, r)
+				break
+			}
+			if !result.Success {
+				break
+			}
+		}
+
+		if step.Send != "" {
+			if err := src.send(step.Send); err != nil {
+				result.Success = false
+				result.Error = fmt.Sprintf("step %d: %v", i+1, err)
+				result.Steps = append(result.Steps, r)
+				break
+			}
+			r.Sent = true
+		}
+		result.Steps = append(result.Steps, r)
+	}
+
+	if js != nil {
+		result.NextOffset = js.offset
+	}
+	return result, nil
+}
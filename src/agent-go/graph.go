@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// validateGraph checks that step names are unique, dependencies exist and there are no cycles
+func validateGraph(steps []GraphStep) error {
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if step.Name == "" {
+			return fmt.Errorf("step %d has no name", i+1)
+		}
+		if _, ok := index[step.Name]; ok {
+			return fmt.Errorf("duplicate step name: %s", step.Name)
+		}
+		index[step.Name] = i
+	}
+
+	// Kahn's algorithm: if some steps never become ready, they form a cycle
+	pending := make([]int, len(steps))
+	dependents := make([][]int, len(steps))
+	for i, step := range steps {
+		for _, dep := range step.DependsOn {
+			d, ok := index[dep]
+			if !ok {
+				return fmt.Errorf("step %s depends on unknown step %s", step.Name, dep)
+			}
+			pending[i]++
+			dependents[d] = append(dependents[d], i)
+		}
+	}
+	var ready []int
+	for i := range steps {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	visited := 0
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, d := range dependents[i] {
+			if pending[d]--; pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if visited != len(steps) {
+		return fmt.Errorf("steps have a dependency cycle")
+	}
+	return nil
+}
+
+// stepFailed reports whether a step's result counts as a failure
+func stepFailed(res *ExecuteResult) bool {
+	return res.ExitCode != 0 || res.TimedOut || res.IdleTimedOut || res.WaitingForInput || res.Cancelled || res.StartError != ""
+}
+
+// ========== Command graph handlers ==========
+
+// handleExecuteGraph runs steps as soon as their dependencies have succeeded,
+// independent ones in parallel (within the concurrency limit). A failed step
+// causes its dependents to be skipped unless it allows failure.
+//
+// Like execute, the steps keep running if the connection closes; only cancel
+// (or a step's timeouts) stops them.
+func (s *Server) handleExecuteGraph(ctx context.Context, st *connState, conn *jsonrpc2.Conn, requestID jsonrpc2.ID, params *ExecuteGraphParams) (*ExecuteGraphResult, error) {
+	if len(params.Steps) == 0 {
+		return nil, fmt.Errorf("no steps given")
+	}
+	if err := validateGraph(params.Steps); err != nil {
+		return nil, err
+	}
+
+	// Cancelling any step (e.g. with cancel for the graph's request ID) stops the whole graph
+	ctx, cancelGraph := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelGraph()
+
+	startTime := time.Now()
+	results := make([]GraphStepResult, len(params.Steps))
+	done := make(map[string]chan struct{}, len(params.Steps))
+	blocked := make(map[string]bool, len(params.Steps)) // Failed or skipped, so dependents must not run
+	var mu sync.Mutex
+	for _, step := range params.Steps {
+		done[step.Name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for i := range params.Steps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			step := &params.Steps[i]
+			r := &results[i]
+			r.Name = step.Name
+			defer close(done[step.Name])
+
+			for _, dep := range step.DependsOn {
+				<-done[dep]
+			}
+
+			mu.Lock()
+			for _, dep := range step.DependsOn {
+				if blocked[dep] {
+					r.Status = GraphStepSkipped
+					r.Error = fmt.Sprintf("dependency %s did not succeed", dep)
+					break
+				}
+			}
+			mu.Unlock()
+
+			if r.Status == "" {
+				r.Result, r.Error = s.runGraphStep(ctx, st, conn, requestID, step)
+				switch {
+				case r.Result == nil || stepFailed(r.Result):
+					r.Status = GraphStepFailed
+				default:
+					r.Status = GraphStepSucceeded
+				}
+				if r.Result != nil && r.Result.Cancelled {
+					cancelGraph()
+				}
+			}
+
+			if r.Status == GraphStepSkipped || (r.Status == GraphStepFailed && !step.AllowFailure) {
+				mu.Lock()
+				blocked[step.Name] = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	result := &ExecuteGraphResult{
+		Success:    true,
+		Steps:      results,
+		DurationMs: time.Since(startTime).Milliseconds(),
+	}
+	for i, r := range results {
+		if r.Status == GraphStepSkipped || (r.Status == GraphStepFailed && !params.Steps[i].AllowFailure) {
+			result.Success = false
+		}
+	}
+	return result, nil
+}
+
+// runGraphStep runs one step like execute, returning an error message if it could not be run at all
+func (s *Server) runGraphStep(ctx context.Context, st *connState, conn *jsonrpc2.Conn, requestID jsonrpc2.ID, step *GraphStep) (*ExecuteResult, string) {
+	params := step.ExecuteParams
+	st.applyToExecute(&params)
+
+	e, err := s.newExecution(&params)
+	if err != nil {
+		return nil, err.Error()
+	}
+	e.conn = conn
+	e.requestID = requestID.String()
+	e.limited = true
+	return s.runExecution(ctx, e), ""
+}
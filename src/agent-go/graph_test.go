@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateGraph(t *testing.T) {
+	step := func(name string, deps ...string) GraphStep {
+		return GraphStep{Name: name, DependsOn: deps}
+	}
+
+	tests := []struct {
+		name  string
+		steps []GraphStep
+		err   string // Expected in the error, or "" for a valid graph
+	}{
+		{name: "single step", steps: []GraphStep{step("a")}},
+		{name: "independent steps", steps: []GraphStep{step("a"), step("b")}},
+		{name: "diamond", steps: []GraphStep{step("d", "b", "c"), step("b", "a"), step("c", "a"), step("a")}},
+		{name: "missing name", steps: []GraphStep{step("a"), step("")}, err: "step 2 has no name"},
+		{name: "duplicate name", steps: []GraphStep{step("a"), step("a")}, err: "duplicate step name: a"},
+		{name: "unknown dependency", steps: []GraphStep{step("a", "b")}, err: "depends on unknown step b"},
+		{name: "self dependency", steps: []GraphStep{step("a", "a")}, err: "cycle"},
+		{name: "cycle", steps: []GraphStep{step("a", "c"), step("b", "a"), step("c", "b")}, err: "cycle"},
+		{name: "cycle beside valid steps", steps: []GraphStep{step("a"), step("b", "a", "c"), step("c", "b")}, err: "cycle"},
+	}
+
+	for _, tt := range tests {
+		err := validateGraph(tt.steps)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: no error, want %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q, want %q", tt.name, err, tt.err)
+		}
+	}
+}
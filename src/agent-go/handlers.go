@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
@@ -10,6 +13,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
 )
 
 const (
@@ -17,6 +22,65 @@ const (
 	DefaultCwd = "/workspace"
 	// DefaultTimeout is the default timeout for command execution in seconds
 	DefaultTimeout = 300
+	// DefaultGracePeriodMs is how long a timed out or cancelled command gets
+	// to exit after SIGTERM before its process group is SIGKILLed
+	DefaultGracePeriodMs = 2000
+	// OutputWaitDelay bounds how long to wait for output pipes to close after
+	// the command exits, in case a process outside its group still holds them
+	OutputWaitDelay = 1 * time.Second
+	// DefaultMaxOutputBytes is the default per-stream limit on output kept in memory
+	DefaultMaxOutputBytes = 1 << 20
+	// OutputSpillDir holds the full output of commands that exceeded their limit
+	OutputSpillDir = "/tmp/otus-output"
+	// MaxSpilledOutputs is how many spilled outputs are kept before the oldest is deleted
+	MaxSpilledOutputs = 32
+	// DefaultReadOutputLength is the default chunk size for read_output
+	DefaultReadOutputLength = 64 * 1024
+	// MaxReadOutputLength caps the chunk size for read_output and read_process_output
+	MaxReadOutputLength = 4 << 20
+	// DefaultReadFileBytes and MaxReadFileBytes limit how much read_file returns
+	DefaultReadFileBytes = 8 << 20
+	MaxReadFileBytes     = 64 << 20
+	// JobOutputDir holds the output logs of background processes
+	JobOutputDir = "/tmp/otus-jobs"
+	// DefaultPTYRows and DefaultPTYCols are the terminal size for PTY executions
+	DefaultPTYRows = 24
+	DefaultPTYCols = 80
+	// Network modes for ExecuteParams.Network
+	NetworkDefault  = "default"  // Share the VM's network
+	NetworkNone     = "none"     // New network namespace without any interface up
+	NetworkLoopback = "loopback" // New network namespace with only lo up
+	// Output formats for ExecuteParams.Output
+	OutputSeparate    = "separate"
+	OutputInterleaved = "interleaved"
+	OutputBoth        = "both"
+	// Output encodings for ExecuteParams.Encoding
+	EncodingAuto   = "auto"
+	EncodingUTF8   = "utf8"
+	EncodingBase64 = "base64"
+	// MaxExecutionHistory is how many finished executions list_executions remembers
+	MaxExecutionHistory = 100
+	// HistoryOutputBytes is how much of each stream the history keeps per execution
+	HistoryOutputBytes = 16 * 1024
+	// InputCheckInterval is how often a PTY execution is checked for waiting on input
+	InputCheckInterval = 500 * time.Millisecond
+	// InputWaitDelay is how long output must have stopped before a prompt counts as waiting
+	InputWaitDelay = time.Second
+	// Statuses of execute_graph steps
+	GraphStepSucceeded = "succeeded"
+	GraphStepFailed    = "failed"
+	GraphStepSkipped   = "skipped"
+	// ExpectDir holds the piped output of tmux sessions during expect
+	ExpectDir = "/tmp/otus-expect"
+	// DefaultExpectTimeout is how long an expect step waits for its pattern, in seconds
+	DefaultExpectTimeout = 30
+	// ExpectPollInterval is how often expect checks for new output
+	ExpectPollInterval = 50 * time.Millisecond
+	// MaxExpectOutputBytes caps the output returned per expect step (the end is kept)
+	MaxExpectOutputBytes = 64 * 1024
+	// MaxJobs is how many background processes are remembered; the oldest
+	// finished ones are forgotten (and their logs deleted) past this
+	MaxJobs = 64
 )
 
 // handleHealth returns the current health status of the agent
@@ -29,98 +93,301 @@ func (s *Server) handleHealth() *HealthResult {
 	}
 }
 
-// handleExecute executes a shell command and returns the result
-func (s *Server) handleExecute(params *ExecuteParams) (*ExecuteResult, error) {
-	cwd := params.Cwd
-	if cwd == "" {
-		cwd = DefaultCwd
+// handleExecute executes a shell command and returns the result.
+//
+// The command is only stopped early by cancel (or its timeouts), not by the
+// connection closing: an execute_started notification gives the host the
+// execution ID up front, so after a dropped connection it can reconnect and
+// get the result with get_execution (or stop the command with cancel).
+func (s *Server) handleExecute(ctx context.Context, conn *jsonrpc2.Conn, requestID jsonrpc2.ID, params *ExecuteParams) (*ExecuteResult, error) {
+	e, err := s.newExecution(params)
+	if err != nil {
+		return nil, err
 	}
+	e.conn = conn
+	e.requestID = requestID.String()
+	e.limited = true
+
+	conn.Notify(context.Background(), "execute_started", &ExecuteStartedNotification{
+		ExecutionID: e.id,
+		RequestID:   requestID,
+	})
+	return s.runExecution(context.WithoutCancel(ctx), e), nil
+}
 
-	timeout := params.Timeout
-	if timeout <= 0 {
-		timeout = DefaultTimeout
+// handleExecuteStream starts a shell command and returns its execution ID immediately.
+// Output is pushed to the host as execute_output notifications while the command runs,
+// followed by a single execute_exit notification once it finishes. Like execute,
+// the command keeps running if the connection closes; get_execution has its result.
+func (s *Server) handleExecuteStream(ctx context.Context, conn *jsonrpc2.Conn, params *ExecuteParams) (*ExecuteStreamResult, error) {
+	e, err := s.newExecution(params)
+	if err != nil {
+		return nil, err
 	}
 
-	// Decode command from base64 (all commands are base64-encoded)
-	if params.Command == "" {
-		return nil, fmt.Errorf("no command provided")
+	// Output is delivered through notifications only, so there is nothing to buffer
+	e.capture = false
+	e.limited = true
+
+	var seq uint64
+	notify := func(stream string, data []byte) {
+		n := &ExecuteOutputNotification{ExecutionID: e.id, Stream: stream}
+		if n.Data, n.Encoding = encodeText(string(data), e.encoding); n.Encoding == EncodingUTF8 {
+			n.Encoding = ""
+		}
+		seq++
+		n.Seq = seq
+		conn.Notify(context.Background(), "execute_output", n)
+	}
+
+	// In auto mode a character split between two reads is held back until
+	// the rest arrives, so it doesn't make either notification binary
+	partial := map[string][]byte{}
+	e.onOutput = func(stream string, data []byte) {
+		if e.encoding == "" || e.encoding == EncodingAuto {
+			data = append(partial[stream], data...)
+			data, partial[stream] = splitPartialRune(data)
+			partial[stream] = append([]byte(nil), partial[stream]...)
+			if len(data) == 0 {
+				return
+			}
+		}
+		notify(stream, data)
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(params.Command)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode base64 command: %w", err)
+	e.conn = conn
+
+	go func() {
+		result := s.runExecution(context.WithoutCancel(ctx), e)
+		// cmd.Wait has returned, so every output chunk has already been sent
+		for _, stream := range []string{StreamStdout, StreamStderr} {
+			if len(partial[stream]) > 0 {
+				notify(stream, partial[stream])
+			}
+		}
+		seq++
+		conn.Notify(context.Background(), "execute_exit", &ExecuteExitNotification{
+			ExecutionID:   e.id,
+			Seq:           seq,
+			ExecuteResult: result,
+		})
+	}()
+
+	return &ExecuteStreamResult{ExecutionID: e.id}, nil
+}
+
+// handleCancel stops an in-flight execution and returns its partial result.
+// It is the only way to stop a command early, since closing the connection
+// does not.
+func (s *Server) handleCancel(conn *jsonrpc2.Conn, params *CancelParams) (*ExecuteResult, error) {
+	if params.ExecutionID == "" && params.RequestID == nil {
+		return nil, fmt.Errorf("executionId or requestId is required")
 	}
-	command := string(decoded)
 
-	startTime := time.Now()
+	e := s.findExecution(conn, params.ExecutionID, params.RequestID)
+	if e == nil {
+		return nil, fmt.Errorf("no running execution found")
+	}
 
-	// Use bash instead of sh for better compatibility (source, arrays, etc.)
-	cmd := exec.Command("bash", "-c", command)
-	cmd.Dir = cwd
-	cmd.Env = os.Environ()
-	for k, v := range params.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	e.cancel()
+	return e.wait(), nil
+}
+
+// handleReadOutput returns a byte range of the full output of a truncated execution
+func (s *Server) handleReadOutput(params *ReadOutputParams) (*ReadOutputResult, error) {
+	if !s.hasOutput(params.OutputID) {
+		return nil, fmt.Errorf("unknown output ID: %s", params.OutputID)
 	}
 
-	var stdout, stderr strings.Builder
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	stream := params.Stream
+	if stream == "" {
+		stream = StreamStdout
+	}
+	if stream != StreamStdout && stream != StreamStderr {
+		return nil, fmt.Errorf("invalid stream: %s", stream)
+	}
 
-	if err := cmd.Start(); err != nil {
-		return &ExecuteResult{
-			Stdout:     "",
-			Stderr:     err.Error(),
-			ExitCode:   -1,
-			DurationMs: time.Since(startTime).Milliseconds(),
-		}, nil
+	length := params.Length
+	if length <= 0 {
+		length = DefaultReadOutputLength
+	}
+	if length > MaxReadOutputLength {
+		length = MaxReadOutputLength
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
+	f, err := os.Open(spillPath(params.OutputID, stream))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Only the other stream exceeded its limit
+			return nil, fmt.Errorf("no spilled %s for output %s", stream, params.OutputID)
+		}
+		return nil, err
+	}
+	defer f.Close()
 
-	var timedOut bool
-	select {
-	case err := <-done:
-		exitCode := 0
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
-			} else {
-				exitCode = -1
-			}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, params.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return &ReadOutputResult{
+		Content:   base64.StdEncoding.EncodeToString(buf[:n]),
+		Offset:    params.Offset,
+		BytesRead: n,
+		TotalSize: info.Size(),
+		EOF:       params.Offset+int64(n) >= info.Size(),
+	}, nil
+}
+
+// readFileLines reads lines startLine to endLine of r (counted from 1; endLine 0
+// reads to the end), stopping before maxBytes is exceeded. It returns the lines,
+// the offset of the first one and whether the file continues after them.
+func readFileLines(r io.Reader, startLine, endLine, maxBytes int) ([]FileLine, int64, bool, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var lines []FileLine
+	var offset, start int64
+	used := 0
+	for number := 1; endLine == 0 || number <= endLine; number++ {
+		if number <= startLine {
+			start = offset
 		}
-		return &ExecuteResult{
-			Stdout:     stdout.String(),
-			Stderr:     stderr.String(),
-			ExitCode:   exitCode,
-			DurationMs: time.Since(startTime).Milliseconds(),
-			TimedOut:   false,
-		}, nil
+		keep := number >= startLine
+
+		// Lines longer than the buffer arrive in pieces
+		var text []byte
+		for {
+			piece, err := br.ReadSlice('\n')
+			offset += int64(len(piece))
+			if keep {
+				if room := maxBytes - used - len(text); len(piece) > room {
+					// Only a line that doesn't fit on its own is cut; otherwise it waits for the next read
+					if len(lines) == 0 {
+						text = append(text, piece[:room]...)
+						lines = append(lines, FileLine{Number: number, Text: lineText(text), Truncated: true})
+					}
+					return lines, start, true, nil
+				}
+				text = append(text, piece...)
+			}
 
-	case <-time.After(time.Duration(timeout) * time.Second):
-		timedOut = true
-		if cmd.Process != nil {
-			cmd.Process.Signal(syscall.SIGTERM)
-			time.Sleep(100 * time.Millisecond)
-			cmd.Process.Kill()
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				// The last line may lack a newline
+				if len(text) > 0 {
+					lines = append(lines, FileLine{Number: number, Text: lineText(text)})
+				}
+				if !keep {
+					start = offset // The file ended before startLine
+				}
+				return lines, start, false, nil
+			}
+			if err != nil {
+				return nil, 0, false, err
+			}
+			break
+		}
+		if keep {
+			used += len(text)
+			lines = append(lines, FileLine{Number: number, Text: lineText(text)})
 		}
-		<-done
 	}
 
-	return &ExecuteResult{
-		Stdout:     stdout.String(),
-		Stderr:     stderr.String(),
-		ExitCode:   -1,
-		DurationMs: time.Since(startTime).Milliseconds(),
-		TimedOut:   timedOut,
-	}, nil
+	_, err := br.Peek(1)
+	return lines, start, err == nil, nil
+}
+
+// lineText returns a line without its line ending, as valid UTF-8
+func lineText(line []byte) string {
+	line, _ = splitPartialRune(line)
+	text := strings.TrimSuffix(string(line), "\n")
+	text = strings.TrimSuffix(text, "\r")
+	return strings.ToValidUTF8(text, "\uFFFD")
 }
 
-// handleReadFile reads a file and returns its content (base64 encoded)
+// handleReadFile reads a file, or a byte or line range of it, and returns its
+// content (base64 encoded, or as numbered lines)
 func (s *Server) handleReadFile(params *ReadFileParams) (*ReadFileResult, error) {
-	content, err := os.ReadFile(params.Path)
+	if params.Offset < 0 || params.Length < 0 || params.MaxBytes < 0 || params.StartLine < 0 || params.EndLine < 0 {
+		return nil, fmt.Errorf("offset, length, maxBytes and line numbers cannot be negative")
+	}
+	lineRange := params.StartLine > 0 || params.EndLine > 0
+	if lineRange && (params.Offset > 0 || params.Length > 0) {
+		return nil, fmt.Errorf("a line range cannot be combined with offset and length")
+	}
+	startLine := max(params.StartLine, 1)
+	if params.EndLine > 0 && params.EndLine < startLine {
+		return nil, fmt.Errorf("endLine %d is before startLine %d", params.EndLine, startLine)
+	}
+
+	maxBytes := params.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultReadFileBytes
+	}
+	maxBytes = min(maxBytes, MaxReadFileBytes)
+
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReadFileResult{Exists: true}
+	err = withUserFS(cred, func() error {
+		f, err := os.Open(params.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		result.Size = info.Size()
+
+		if lineRange {
+			lines, offset, more, err := readFileLines(f, startLine, params.EndLine, maxBytes)
+			if err != nil {
+				return err
+			}
+			result.Lines = lines
+			result.Offset = offset
+			result.Partial = startLine > 1 || more
+			return nil
+		}
+
+		if params.Offset > 0 {
+			if _, err := f.Seek(params.Offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		limit := int64(maxBytes)
+		if params.Length > 0 {
+			limit = min(limit, params.Length)
+		}
+		// Read a byte more than needed to tell whether the file continues.
+		// The size from stat isn't used, as files in /proc report 0.
+		content, err := io.ReadAll(io.LimitReader(f, limit+1))
+		if err != nil {
+			return err
+		}
+		more := int64(len(content)) > limit
+		if more {
+			content = content[:limit]
+		}
+		result.Content = base64.StdEncoding.EncodeToString(content)
+		result.Offset = params.Offset
+		result.BytesRead = len(content)
+		result.Partial = params.Offset > 0 || more
+		return nil
+	})
 	if err != nil {
 		if os.IsNotExist(err) {
 			return &ReadFileResult{
@@ -130,13 +397,7 @@ func (s *Server) handleReadFile(params *ReadFileParams) (*ReadFileResult, error)
 		}
 		return nil, err
 	}
-
-	info, _ := os.Stat(params.Path)
-	return &ReadFileResult{
-		Content: base64.StdEncoding.EncodeToString(content),
-		Exists:  true,
-		Size:    info.Size(),
-	}, nil
+	return result, nil
 }
 
 // handleWriteFile writes content to a file
@@ -146,11 +407,9 @@ func (s *Server) handleWriteFile(params *WriteFileParams) (*WriteFileResult, err
 		return nil, fmt.Errorf("invalid base64 content: %v", err)
 	}
 
-	dir := filepath.Dir(params.Path)
-	if dir != "" {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
-		}
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return nil, err
 	}
 
 	mode := params.Mode
@@ -158,7 +417,17 @@ func (s *Server) handleWriteFile(params *WriteFileParams) (*WriteFileResult, err
 		mode = 0644
 	}
 
-	if err := os.WriteFile(params.Path, content, fs.FileMode(mode)); err != nil {
+	// As a user, created files and directories are owned by that user
+	err = withUserFS(cred, func() error {
+		dir := filepath.Dir(params.Path)
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		return os.WriteFile(params.Path, content, fs.FileMode(mode))
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -170,6 +439,22 @@ func (s *Server) handleWriteFile(params *WriteFileParams) (*WriteFileResult, err
 
 // handleListDir lists directory contents
 func (s *Server) handleListDir(params *ListDirParams) (*ListDirResult, error) {
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ListDirResult
+	err = withUserFS(cred, func() error {
+		var err error
+		result, err = listDir(params)
+		return err
+	})
+	return result, err
+}
+
+// listDir lists directory contents with the current filesystem credentials
+func listDir(params *ListDirParams) (*ListDirResult, error) {
 	var entries []DirEntry
 
 	if params.Recursive {
@@ -233,8 +518,13 @@ func (s *Server) handleSyncToGuest(params *SyncToGuestParams) (*SyncToGuestResul
 		basePath = DefaultCwd
 	}
 
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return &SyncToGuestResult{Success: false, Error: err.Error()}, nil
+	}
+
 	// Ensure base path exists
-	if err := os.MkdirAll(basePath, 0755); err != nil {
+	if err := withUserFS(cred, func() error { return os.MkdirAll(basePath, 0755) }); err != nil {
 		return &SyncToGuestResult{Success: false, Error: err.Error()}, nil
 	}
 
@@ -251,8 +541,11 @@ func (s *Server) handleSyncToGuest(params *SyncToGuestParams) (*SyncToGuestResul
 	}
 	defer os.Remove(tmpFile)
 
-	// Extract using tar command
+	// Extract using tar command. As a user, tar creates files owned by that user.
 	cmd := exec.Command("tar", "-xzf", tmpFile, "-C", basePath)
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred.credential()}
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return &SyncToGuestResult{
@@ -285,6 +578,11 @@ func (s *Server) handleSyncFromGuest(params *SyncFromGuestParams) (*SyncFromGues
 		return &SyncFromGuestResult{TarData: "", Size: 0}, nil
 	}
 
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return nil, err
+	}
+
 	// Build exclude arguments from host-provided patterns only
 	// (no default excludes - .otusignore on host is the single source of truth)
 	excludeArgs := make([]string, 0, len(params.Excludes)*2)
@@ -300,6 +598,9 @@ func (s *Server) handleSyncFromGuest(params *SyncFromGuestParams) (*SyncFromGues
 	args = append(args, "-C", basePath, ".")
 
 	cmd := exec.Command("tar", args...)
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred.credential()}
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		// tar might return non-zero for warnings, check if file was created
@@ -339,6 +640,11 @@ func (s *Server) handleStartSession(params *StartSessionParams) (*StartSessionRe
 		cwd = DefaultCwd
 	}
 
+	cred, err := lookupOptionalUser(params.User)
+	if err != nil {
+		return &StartSessionResult{Name: params.Name, Success: false, Error: err.Error()}, nil
+	}
+
 	// Check if session already exists
 	checkCmd := exec.Command("tmux", "has-session", "-t", params.Name)
 	if err := checkCmd.Run(); err == nil {
@@ -349,7 +655,27 @@ func (s *Server) handleStartSession(params *StartSessionParams) (*StartSessionRe
 	}
 
 	// Create new tmux session (detached)
-	cmd := exec.Command("tmux", "new-session", "-d", "-s", params.Name, "-c", cwd)
+	args := []string{"new-session", "-d", "-s", params.Name, "-c", cwd}
+	for k, v := range params.Env {
+		args = append(args, "-e", k+"="+v)
+	}
+	var command []string
+	if cred != nil {
+		command = cred.sessionCommand()
+	}
+	if len(params.UnsetEnv) > 0 {
+		// tmux can only add to a session's environment, so env removes these
+		if command == nil {
+			command = []string{"bash", "-l"}
+		}
+		unset := []string{"env"}
+		for _, k := range params.UnsetEnv {
+			unset = append(unset, "-u", k)
+		}
+		command = append(unset, command...)
+	}
+	args = append(args, command...)
+	cmd := exec.Command("tmux", args...)
 	cmd.Env = os.Environ()
 
 	if output, err := cmd.CombinedOutput(); err != nil {
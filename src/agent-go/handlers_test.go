@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadFileLines(t *testing.T) {
+	const text = "one\ntwo\r\nthree\nfour"
+	long := strings.Repeat("x", 100000) + "\nafter\n"
+
+	tests := []struct {
+		name      string
+		input     string
+		startLine int
+		endLine   int
+		maxBytes  int
+		want      []FileLine
+		offset    int64
+		more      bool
+	}{
+		{name: "whole file", input: text, startLine: 1,
+			want: []FileLine{{Number: 1, Text: "one"}, {Number: 2, Text: "two"}, {Number: 3, Text: "three"}, {Number: 4, Text: "four"}}},
+		{name: "middle", input: text, startLine: 2, endLine: 3,
+			want: []FileLine{{Number: 2, Text: "two"}, {Number: 3, Text: "three"}}, offset: 4, more: true},
+		{name: "to the end", input: text, startLine: 3,
+			want: []FileLine{{Number: 3, Text: "three"}, {Number: 4, Text: "four"}}, offset: 9},
+		{name: "end past the file", input: text, startLine: 4, endLine: 10,
+			want: []FileLine{{Number: 4, Text: "four"}}, offset: 15},
+		{name: "start past the file", input: text, startLine: 9, want: nil, offset: 19},
+		{name: "trailing newline", input: "a\nb\n", startLine: 1, endLine: 2,
+			want: []FileLine{{Number: 1, Text: "a"}, {Number: 2, Text: "b"}}},
+		{name: "empty lines", input: "\n\nc", startLine: 1,
+			want: []FileLine{{Number: 1, Text: ""}, {Number: 2, Text: ""}, {Number: 3, Text: "c"}}},
+		{name: "stops before maxBytes", input: text, startLine: 1, maxBytes: 9,
+			want: []FileLine{{Number: 1, Text: "one"}, {Number: 2, Text: "two"}}, more: true},
+		{name: "long line cut", input: long, startLine: 1, maxBytes: 10,
+			want: []FileLine{{Number: 1, Text: "xxxxxxxxxx", Truncated: true}}, more: true},
+		{name: "line after a long one", input: long, startLine: 2,
+			want: []FileLine{{Number: 2, Text: "after"}}, offset: 100001},
+		{name: "invalid UTF-8 replaced", input: "a\xffb\n", startLine: 1,
+			want: []FileLine{{Number: 1, Text: "a�b"}}},
+	}
+
+	for _, tt := range tests {
+		maxBytes := tt.maxBytes
+		if maxBytes == 0 {
+			maxBytes = DefaultReadFileBytes
+		}
+		lines, offset, more, err := readFileLines(strings.NewReader(tt.input), tt.startLine, tt.endLine, maxBytes)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+
+		if len(lines) != len(tt.want) {
+			t.Errorf("%s: lines = %+v, want %+v", tt.name, lines, tt.want)
+		} else {
+			for i := range lines {
+				if lines[i] != tt.want[i] {
+					t.Errorf("%s: line %d = %+v, want %+v", tt.name, i, lines[i], tt.want[i])
+				}
+			}
+		}
+		if offset != tt.offset || more != tt.more {
+			t.Errorf("%s: offset %d, more %v, want %d, %v", tt.name, offset, more, tt.offset, tt.more)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Some per-command setup (rlimits, umask, loopback in a new network
+// namespace) has to happen inside the child between fork and exec, which
+// os/exec cannot do. For those commands the agent re-executes itself as a
+// small helper that applies the setup and then execs the real command in
+// place, so the PID (and process group) stays the same.
+const (
+	// execHelperArg is argv[1] of the agent when running as the exec helper
+	execHelperArg = "__otus_exec"
+	// execHelperEnv carries the JSON-encoded helperSpec to the helper
+	execHelperEnv = "OTUS_EXEC_SPEC"
+)
+
+// helperSpec describes the setup the exec helper applies before exec
+type helperSpec struct {
+	Rlimits    []helperRlimit `json:"rlimits,omitempty"`
+	LoopbackUp bool           `json:"loopbackUp,omitempty"` // Bring up lo in the (new) network namespace
+	Umask      *int           `json:"umask,omitempty"`
+
+	// Credential to switch to last, once the privileged setup is done.
+	// Set instead of SysProcAttr.Credential whenever the helper is used.
+	Credential *syscall.Credential `json:"credential,omitempty"`
+}
+
+// helperRlimit is a resource limit to apply (soft and hard)
+type helperRlimit struct {
+	Resource int    `json:"resource"`
+	Limit    uint64 `json:"limit"`
+}
+
+// empty reports whether the spec requires no setup, so the helper can be skipped
+func (h *helperSpec) empty() bool {
+	return len(h.Rlimits) == 0 && !h.LoopbackUp && h.Umask == nil
+}
+
+// wrapWithHelper rewrites cmd to start through the exec helper.
+// It must be called after cmd.Env has been set.
+func wrapWithHelper(cmd *exec.Cmd, spec *helperSpec) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate agent executable: %w", err)
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append([]string{self, execHelperArg, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, execHelperEnv+"="+string(data))
+	return nil
+}
+
+// runExecHelper is the entry point of the exec helper: os.Args is
+// [agent, execHelperArg, path, argv...]. It never returns.
+func runExecHelper() {
+	if len(os.Args) < 4 {
+		helperFail(fmt.Errorf("missing command"))
+	}
+
+	var spec helperSpec
+	if err := json.Unmarshal([]byte(os.Getenv(execHelperEnv)), &spec); err != nil {
+		helperFail(fmt.Errorf("invalid spec: %w", err))
+	}
+	os.Unsetenv(execHelperEnv)
+
+	// Use the syscall package so the runtime does not restore its saved
+	// RLIMIT_NOFILE over ours on exec
+	for _, rl := range spec.Rlimits {
+		lim := &syscall.Rlimit{Cur: rl.Limit, Max: rl.Limit}
+		if err := syscall.Setrlimit(rl.Resource, lim); err != nil {
+			helperFail(fmt.Errorf("setrlimit %d: %w", rl.Resource, err))
+		}
+	}
+
+	if spec.Umask != nil {
+		syscall.Umask(*spec.Umask)
+	}
+
+	if spec.LoopbackUp {
+		if err := bringUpLoopback(); err != nil {
+			helperFail(fmt.Errorf("loopback: %w", err))
+		}
+	}
+
+	if c := spec.Credential; c != nil {
+		groups := make([]int, len(c.Groups))
+		for i, g := range c.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			helperFail(fmt.Errorf("setgroups: %w", err))
+		}
+		if err := syscall.Setgid(int(c.Gid)); err != nil {
+			helperFail(fmt.Errorf("setgid: %w", err))
+		}
+		if err := syscall.Setuid(int(c.Uid)); err != nil {
+			helperFail(fmt.Errorf("setuid: %w", err))
+		}
+	}
+
+	path, argv := os.Args[2], os.Args[3:]
+	err := syscall.Exec(path, argv, os.Environ())
+	helperFail(fmt.Errorf("exec %s: %w", path, err))
+}
+
+// bringUpLoopback sets the IFF_UP flag on lo in the current network namespace
+func bringUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// helperFail reports a setup error on stderr and exits like a shell that
+// could not run the command
+func helperFail(err error) {
+	fmt.Fprintf(os.Stderr, "otus-agent: %v\n", err)
+	os.Exit(127)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// record describes e, which may still be waiting in the queue
+func (e *execution) record() *ExecutionRecord {
+	rec := &ExecutionRecord{
+		ExecutionID: e.id,
+		Command:     e.command,
+		Cwd:         e.cmd.Dir,
+		EnvKeys:     e.envKeys,
+	}
+	select {
+	case <-e.started:
+	default:
+		rec.Queued = true
+		return rec
+	}
+
+	rec.Running = true
+	rec.StartedAt = e.startTime.UnixMilli()
+	rec.DurationMs = time.Since(e.startTime).Milliseconds()
+	if res := e.finished(); res != nil {
+		rec.Running = false
+		rec.DurationMs = res.DurationMs
+		rec.EndedAt = e.startTime.Add(time.Duration(res.DurationMs) * time.Millisecond).UnixMilli()
+		rec.ExitCode = res.ExitCode
+		rec.Result = historyResult(res)
+	}
+	return rec
+}
+
+// historyResult copies a result with its output cut down for keeping in the history
+func historyResult(res *ExecuteResult) *ExecuteResult {
+	kept := *res
+	kept.Chunks = nil
+	kept.ChunksTruncated = false
+
+	cut := func(out, encoding string) (string, bool) {
+		if len(out) <= HistoryOutputBytes {
+			return out, false
+		}
+		start := len(out) - HistoryOutputBytes
+		if encoding == EncodingBase64 {
+			// Keep whole base64 quanta, so the tail still decodes
+			start += (4 - start%4) % 4
+			return out[start:], true
+		}
+		return string(trimContinuationBytes([]byte(out[start:]))), true
+	}
+
+	var truncated bool
+	if kept.Stdout, truncated = cut(res.Stdout, res.StdoutEncoding); truncated {
+		kept.StdoutTruncated = true
+	}
+	if kept.Stderr, truncated = cut(res.Stderr, res.StderrEncoding); truncated {
+		kept.StderrTruncated = true
+	}
+	return &kept
+}
+
+// recordExecution adds a finished execution to the history, forgetting the
+// oldest past MaxExecutionHistory
+func (s *Server) recordExecution(e *execution) {
+	rec := e.record()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = append(s.history, rec)
+	if len(s.history) > MaxExecutionHistory {
+		s.history = append([]*ExecutionRecord(nil), s.history[len(s.history)-MaxExecutionHistory:]...)
+	}
+}
+
+// ========== Execution history handlers ==========
+
+// handleListExecutions lists queued and running executions and the history, newest first.
+// Results are left out; get_execution returns them.
+func (s *Server) handleListExecutions(params *ListExecutionsParams) *ListExecutionsResult {
+	s.mu.Lock()
+	var running []*execution
+	for _, e := range s.executions {
+		running = append(running, e)
+	}
+	finished := append([]*ExecutionRecord(nil), s.history...)
+	s.mu.Unlock()
+
+	var records []ExecutionRecord
+	seen := map[string]bool{}
+	for _, rec := range finished {
+		r := *rec
+		r.Result = nil
+		records = append(records, r)
+		seen[r.ExecutionID] = true
+	}
+	for _, e := range running {
+		if !seen[e.id] {
+			r := *e.record()
+			r.Result = nil
+			records = append(records, r)
+		}
+	}
+
+	// Queued executions have not started, so they come before all others
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Queued != records[j].Queued {
+			return records[i].Queued
+		}
+		return records[i].StartedAt > records[j].StartedAt
+	})
+	if params.Limit > 0 && len(records) > params.Limit {
+		records = records[:params.Limit]
+	}
+	if records == nil {
+		records = []ExecutionRecord{}
+	}
+	return &ListExecutionsResult{Executions: records}
+}
+
+// handleGetExecution returns a queued, running or remembered execution, with its result once finished
+func (s *Server) handleGetExecution(params *GetExecutionParams) (*ExecutionRecord, error) {
+	s.mu.Lock()
+	e := s.executions[params.ExecutionID]
+	var rec *ExecutionRecord
+	for _, r := range s.history {
+		if r.ExecutionID == params.ExecutionID {
+			rec = r
+		}
+	}
+	s.mu.Unlock()
+
+	if rec != nil {
+		return rec, nil
+	}
+	if e != nil {
+		return e.record(), nil
+	}
+	return nil, fmt.Errorf("execution %s not found", params.ExecutionID)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestQueuedExecutionRecord(t *testing.T) {
+	s := NewServer()
+	s.queue = newExecQueue(1)
+	s.queue.acquire(context.Background(), nil, 0) // Take the only slot
+
+	e, err := s.newExecution(&ExecuteParams{Command: base64.StdEncoding.EncodeToString([]byte("true")), Cwd: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.limited = true
+	done := make(chan *ExecuteResult)
+	go func() { done <- s.runExecution(context.Background(), e) }()
+	waitQueued(t, s.queue, 1)
+
+	// While queued, the execution can be found but has not started
+	rec, err := s.handleGetExecution(&GetExecutionParams{ExecutionID: e.id})
+	if err != nil {
+		t.Fatalf("get_execution while queued: %v", err)
+	}
+	if !rec.Queued || rec.Running || rec.StartedAt != 0 || rec.Result != nil {
+		t.Errorf("record while queued = %+v, want queued and not started", rec)
+	}
+	list := s.handleListExecutions(&ListExecutionsParams{})
+	if len(list.Executions) != 1 || !list.Executions[0].Queued {
+		t.Errorf("list_executions while queued = %+v, want the queued execution", list.Executions)
+	}
+
+	s.queue.release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("execution did not run once a slot was free")
+	}
+
+	rec, err = s.handleGetExecution(&GetExecutionParams{ExecutionID: e.id})
+	if err != nil {
+		t.Fatalf("get_execution after finishing: %v", err)
+	}
+	if rec.Queued || rec.Running || rec.StartedAt == 0 || rec.Result == nil {
+		t.Errorf("record after finishing = %+v, want a finished execution with its result", rec)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// job is a background process started with spawn_process. Its output is
+// appended to files so it can be read incrementally while it runs and after
+// it has exited.
+type job struct {
+	e         *execution
+	command   string
+	startedAt time.Time
+	stdin     io.Writer // Open input for expect, if any
+
+	// Guarded by e.mu, which is held while output is written
+	stdoutFile  *os.File
+	stderrFile  *os.File
+	stdoutBytes int64
+	stderrBytes int64
+}
+
+// jobOutputPath returns the file holding one output stream of a job
+func jobOutputPath(id, stream string) string {
+	return filepath.Join(JobOutputDir, id+"."+stream)
+}
+
+// write appends a chunk of output to the job's log for the stream
+func (j *job) write(stream string, data []byte) {
+	if stream == StreamStderr {
+		j.stderrFile.Write(data)
+		j.stderrBytes += int64(len(data))
+	} else {
+		j.stdoutFile.Write(data)
+		j.stdoutBytes += int64(len(data))
+	}
+}
+
+// status reports the job's current state
+func (j *job) status() *ProcessStatus {
+	st := &ProcessStatus{
+		ID:        j.e.id,
+		Command:   j.command,
+		Running:   true,
+		StartedAt: j.startedAt.UnixMilli(),
+	}
+	if j.e.cmd.Process != nil {
+		st.Pid = j.e.cmd.Process.Pid
+	}
+
+	if res := j.e.finished(); res != nil {
+		st.Running = false
+		st.ExitCode = res.ExitCode
+		st.EndedAt = j.startedAt.Add(time.Duration(res.DurationMs) * time.Millisecond).UnixMilli()
+		st.DurationMs = res.DurationMs
+		st.TimedOut = res.TimedOut
+		st.IdleTimedOut = res.IdleTimedOut
+		st.Cancelled = res.Cancelled
+		st.Usage = res.Usage
+		st.Error = res.StartError
+		st.Signal = res.Signal
+		st.CoreDumped = res.CoreDumped
+		st.OOMKilled = res.OOMKilled
+	} else {
+		st.DurationMs = time.Since(j.startedAt).Milliseconds()
+	}
+
+	j.e.mu.Lock()
+	st.StdoutBytes = j.stdoutBytes
+	st.StderrBytes = j.stderrBytes
+	j.e.mu.Unlock()
+
+	return st
+}
+
+// getJob looks up a job by ID
+func (s *Server) getJob(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown process ID: %s", id)
+	}
+	return j, nil
+}
+
+// addJob records a job, evicting the oldest finished jobs past MaxJobs
+func (s *Server) addJob(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[j.e.id] = j
+	s.jobOrder = append(s.jobOrder, j.e.id)
+
+	for i := 0; len(s.jobs) > MaxJobs && i < len(s.jobOrder); {
+		id := s.jobOrder[i]
+		if s.jobs[id].e.finished() == nil {
+			i++
+			continue
+		}
+		delete(s.jobs, id)
+		s.jobOrder = append(s.jobOrder[:i], s.jobOrder[i+1:]...)
+		os.Remove(jobOutputPath(id, StreamStdout))
+		os.Remove(jobOutputPath(id, StreamStderr))
+	}
+}
+
+// ========== Background process handlers ==========
+
+// handleSpawnProcess starts a command in the background and returns immediately.
+// Unlike execute there is no default timeout, and the process outlives the connection.
+func (s *Server) handleSpawnProcess(params *SpawnProcessParams) (*ProcessStatus, error) {
+	e, err := s.newExecution(&params.ExecuteParams)
+	if err != nil {
+		return nil, err
+	}
+	// Only an explicit timeout applies to background processes
+	e.timeout = time.Duration(params.Timeout) * time.Second
+	e.capture = false
+	// Background processes are answered with expect (given openStdin or pty), so waiting is expected
+	e.inputs = nil
+
+	if err := os.MkdirAll(JobOutputDir, 0755); err != nil {
+		e.release()
+		return nil, err
+	}
+	stdoutFile, err := os.Create(jobOutputPath(e.id, StreamStdout))
+	if err != nil {
+		e.release()
+		return nil, err
+	}
+	stderrFile, err := os.Create(jobOutputPath(e.id, StreamStderr))
+	if err != nil {
+		stdoutFile.Close()
+		os.Remove(stdoutFile.Name())
+		e.release()
+		return nil, err
+	}
+	e.closers = append(e.closers, stdoutFile, stderrFile)
+
+	var stdin io.Writer
+	var stdinRead *os.File
+	if params.OpenStdin && e.ptyMaster == nil {
+		if params.Stdin != "" || params.StdinFile != "" {
+			e.release()
+			return nil, fmt.Errorf("openStdin cannot be combined with stdin or stdinFile")
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			e.release()
+			return nil, err
+		}
+		e.cmd.Stdin = r
+		e.closers = append(e.closers, r, w)
+		stdin, stdinRead = w, r
+	} else if e.ptyMaster != nil {
+		stdin = e.ptyMaster
+	}
+
+	j := &job{
+		e:          e,
+		command:    displayCommand(&params.ExecuteParams),
+		startedAt:  time.Now(),
+		stdoutFile: stdoutFile,
+		stderrFile: stderrFile,
+		stdin:      stdin,
+	}
+	e.onOutput = j.write
+
+	s.addJob(j)
+	go s.runExecution(context.Background(), e)
+	<-e.started
+	if stdinRead != nil {
+		// Only the process keeps the read end, so it sees EOF if the pipe is closed
+		stdinRead.Close()
+	}
+
+	return j.status(), nil
+}
+
+// handleProcessStatus returns the state of a background process
+func (s *Server) handleProcessStatus(params *ProcessIDParams) (*ProcessStatus, error) {
+	j, err := s.getJob(params.ID)
+	if err != nil {
+		return nil, err
+	}
+	return j.status(), nil
+}
+
+// handleReadProcessOutput reads a background process's output from a byte offset
+func (s *Server) handleReadProcessOutput(params *ReadProcessOutputParams) (*ReadProcessOutputResult, error) {
+	j, err := s.getJob(params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := params.Stream
+	if stream == "" {
+		stream = StreamStdout
+	}
+	if stream != StreamStdout && stream != StreamStderr {
+		return nil, fmt.Errorf("invalid stream: %s", stream)
+	}
+
+	length := params.Length
+	if length <= 0 {
+		length = DefaultReadOutputLength
+	}
+	if length > MaxReadOutputLength {
+		length = MaxReadOutputLength
+	}
+
+	// Check for exit before reading, so that a finished process with
+	// nothing after nextOffset really has no more output to come
+	running := j.e.finished() == nil
+
+	f, err := os.Open(jobOutputPath(params.ID, stream))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, params.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadProcessOutputResult{
+		Content:    base64.StdEncoding.EncodeToString(buf[:n]),
+		Offset:     params.Offset,
+		NextOffset: params.Offset + int64(n),
+		TotalSize:  info.Size(),
+		Running:    running,
+	}, nil
+}
+
+// handleWaitProcess waits for a background process to exit, up to a timeout.
+// The returned status has Running set if the timeout expired first.
+func (s *Server) handleWaitProcess(ctx context.Context, params *WaitProcessParams) (*ProcessStatus, error) {
+	j, err := s.getJob(params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	select {
+	case <-j.e.done:
+	case <-time.After(time.Duration(timeout) * time.Second):
+	case <-ctx.Done():
+	}
+	return j.status(), nil
+}
+
+// handleSignalProcess sends a signal to a background process's whole process group
+func (s *Server) handleSignalProcess(params *SignalProcessParams) (*ProcessStatus, error) {
+	j, err := s.getJob(params.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := parseSignal(params.Signal)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.e.finished() == nil && j.e.cmd.Process != nil {
+		if err := syscall.Kill(-j.e.cmd.Process.Pid, sig); err != nil {
+			return nil, fmt.Errorf("failed to signal process: %w", err)
+		}
+	}
+	return j.status(), nil
+}
+
+// parseSignal accepts a signal name ("SIGTERM" or "TERM") or number, defaulting to SIGTERM
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(n), nil
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", name)
+}
@@ -7,7 +7,14 @@
 
 package main
 
+import "os"
+
 func main() {
+	// The agent re-executes itself to set up some commands before exec
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		runExecHelper()
+	}
+
 	server := NewServer()
 	server.Start()
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// outputCapture buffers one output stream of a command in bounded memory.
+// Output is kept whole until it exceeds limit; after that only the first and
+// last limit/2 bytes are retained and the full stream is spilled to a file.
+type outputCapture struct {
+	limit     int
+	spillPath string
+
+	buf   []byte // Everything so far, until the limit is exceeded
+	head  []byte // First bytes, once truncated
+	tail  []byte // Last bytes (with slack), once truncated
+	total int64
+
+	spill     *os.File
+	truncated bool
+}
+
+// chunkLog records the output of both streams in arrival order. Like
+// outputCapture it keeps at most limit bytes: the first and last limit/2.
+type chunkLog struct {
+	limit     int
+	head      []OutputChunk
+	headBytes int
+	tail      []OutputChunk
+	tailBytes int
+	truncated bool
+}
+
+// add records a chunk read from stream at offsetMs, merging it into the
+// previous chunk when that is from the same stream and millisecond
+func (l *chunkLog) add(stream string, offsetMs int64, data []byte) {
+	if room := l.limit/2 - l.headBytes; room > 0 && len(l.tail) == 0 {
+		n := min(room, len(data))
+		l.head = appendChunk(l.head, stream, offsetMs, data[:n])
+		l.headBytes += n
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	l.tail = appendChunk(l.tail, stream, offsetMs, data)
+	l.tailBytes += len(data)
+	for tailSize := l.limit - l.limit/2; l.tailBytes > tailSize; {
+		l.truncated = true
+		over := l.tailBytes - tailSize
+		if first := &l.tail[0]; len(first.Data) > over {
+			first.Data = first.Data[over:]
+			l.tailBytes -= over
+		} else {
+			l.tailBytes -= len(first.Data)
+			l.tail = l.tail[1:]
+		}
+	}
+}
+
+// appendChunk adds data to chunks, extending the last chunk if it matches
+func appendChunk(chunks []OutputChunk, stream string, offsetMs int64, data []byte) []OutputChunk {
+	if n := len(chunks); n > 0 && chunks[n-1].Stream == stream && chunks[n-1].OffsetMs == offsetMs {
+		chunks[n-1].Data += string(data)
+		return chunks
+	}
+	return append(chunks, OutputChunk{Stream: stream, OffsetMs: offsetMs, Data: string(data)})
+}
+
+// chunks returns the retained chunks, oldest first. Characters split between
+// two reads are moved whole into the later chunk.
+func (l *chunkLog) chunks() []OutputChunk {
+	head := mendChunkRunes(append([]OutputChunk(nil), l.head...))
+	tail := mendChunkRunes(append([]OutputChunk(nil), l.tail...))
+
+	if l.truncated {
+		// Drop characters cut in half where chunks were dropped
+		seen := map[string]bool{}
+		for i := len(head) - 1; i >= 0; i-- {
+			if !seen[head[i].Stream] {
+				seen[head[i].Stream] = true
+				complete, _ := splitPartialRune([]byte(head[i].Data))
+				head[i].Data = string(complete)
+			}
+		}
+		seen = map[string]bool{}
+		for i := range tail {
+			if !seen[tail[i].Stream] {
+				seen[tail[i].Stream] = true
+				tail[i].Data = string(trimContinuationBytes([]byte(tail[i].Data)))
+			}
+		}
+	}
+	return append(head, tail...)
+}
+
+// mendChunkRunes moves an incomplete character at the end of a chunk to the
+// start of the next chunk of the same stream
+func mendChunkRunes(chunks []OutputChunk) []OutputChunk {
+	last := map[string]int{}
+	for i, c := range chunks {
+		last[c.Stream] = i
+	}
+
+	carry := map[string]string{}
+	for i := range chunks {
+		c := &chunks[i]
+		data := carry[c.Stream] + c.Data
+		carry[c.Stream] = ""
+		if i != last[c.Stream] {
+			complete, partial := splitPartialRune([]byte(data))
+			data, carry[c.Stream] = string(complete), string(partial)
+		}
+		c.Data = data
+	}
+	return chunks
+}
+
+// splitPartialRune splits b before a UTF-8 sequence cut off at its end
+func splitPartialRune(b []byte) (complete, partial []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], b[i:]
+			}
+			break
+		}
+	}
+	return b, nil
+}
+
+// trimContinuationBytes drops the rest of a UTF-8 sequence whose start was cut off
+func trimContinuationBytes(b []byte) []byte {
+	for i := 0; i < len(b) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(b[i]) {
+			return b[i:]
+		}
+	}
+	return b
+}
+
+// encodeText returns data in the given output encoding, and the encoding used.
+// With auto it stays text unless it is not valid UTF-8, in which case it is
+// base64-encoded so no bytes are lost in JSON.
+func encodeText(data, encoding string) (string, string) {
+	if encoding == EncodingBase64 || (encoding != EncodingUTF8 && !utf8.ValidString(data)) {
+		return base64.StdEncoding.EncodeToString([]byte(data)), EncodingBase64
+	}
+	return data, EncodingUTF8
+}
+
+// encodeOutput applies an output encoding to the output in res. Each stream
+// and chunk is encoded on its own, so invalid bytes on one stream don't turn
+// the other into base64.
+func encodeOutput(res *ExecuteResult, encoding string) {
+	res.Stdout, res.StdoutEncoding = encodeText(res.Stdout, encoding)
+	res.Stderr, res.StderrEncoding = encodeText(res.Stderr, encoding)
+	for i := range res.Chunks {
+		c := &res.Chunks[i]
+		if c.Data, c.Encoding = encodeText(c.Data, encoding); c.Encoding == EncodingUTF8 {
+			c.Encoding = "" // Like stream notifications, only base64 is marked
+		}
+	}
+}
+
+// newOutputCapture creates a capture that spills to spillPath past limit bytes
+func newOutputCapture(limit int, spillPath string) *outputCapture {
+	return &outputCapture{limit: limit, spillPath: spillPath}
+}
+
+// Write records p, switching to head+tail retention when the limit is exceeded
+func (c *outputCapture) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+
+	if !c.truncated {
+		if len(c.buf)+len(p) <= c.limit {
+			c.buf = append(c.buf, p...)
+			return len(p), nil
+		}
+		c.startTruncating(p)
+		return len(p), nil
+	}
+
+	if c.spill != nil {
+		if _, err := c.spill.Write(p); err != nil {
+			c.spill.Close()
+			c.spill = nil
+		}
+	}
+
+	// Let the tail grow to twice its size before trimming, so trimming is amortized
+	tailSize := c.limit - c.limit/2
+	c.tail = append(c.tail, p...)
+	if len(c.tail) > 2*tailSize {
+		c.tail = append([]byte(nil), c.tail[len(c.tail)-tailSize:]...)
+	}
+	return len(p), nil
+}
+
+// startTruncating moves the buffered output to the spill file and keeps only head and tail
+func (c *outputCapture) startTruncating(p []byte) {
+	c.truncated = true
+
+	all := append(c.buf, p...)
+	c.buf = nil
+
+	headSize := c.limit / 2
+	c.head = append([]byte(nil), all[:headSize]...)
+	c.tail = append([]byte(nil), all[len(all)-(c.limit-headSize):]...)
+
+	if err := os.MkdirAll(filepath.Dir(c.spillPath), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(c.spillPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	if _, err := f.Write(all); err != nil {
+		f.Close()
+		os.Remove(c.spillPath)
+		return
+	}
+	c.spill = f
+}
+
+// String returns the retained output, with a marker where bytes were dropped
+func (c *outputCapture) String() string {
+	if !c.truncated {
+		return string(c.buf)
+	}
+
+	tail := c.tail
+	if tailSize := c.limit - c.limit/2; len(tail) > tailSize {
+		tail = tail[len(tail)-tailSize:]
+	}
+	// Don't let the cuts split a character, so text output stays valid UTF-8
+	head, _ := splitPartialRune(c.head)
+	tail = trimContinuationBytes(tail)
+	omitted := c.total - int64(len(c.head)) - int64(len(tail))
+	return fmt.Sprintf("%s\n... [%d bytes truncated] ...\n%s", head, omitted, tail)
+}
+
+// spilled reports whether the full output is available in the spill file
+func (c *outputCapture) spilled() bool {
+	return c.spill != nil
+}
+
+// close finishes writing the spill file
+func (c *outputCapture) close() {
+	if c.spill != nil {
+		c.spill.Close()
+	}
+}
+
+// spillPath returns the file holding the full output of a stream of an execution
+func spillPath(outputID, stream string) string {
+	return filepath.Join(OutputSpillDir, outputID+"."+stream)
+}
+
+// trackOutput records a spilled output, removing the oldest ones past MaxSpilledOutputs
+func (s *Server) trackOutput(outputID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.outputs = append(s.outputs, outputID)
+	for len(s.outputs) > MaxSpilledOutputs {
+		oldest := s.outputs[0]
+		s.outputs = s.outputs[1:]
+		os.Remove(spillPath(oldest, StreamStdout))
+		os.Remove(spillPath(oldest, StreamStderr))
+	}
+}
+
+// hasOutput reports whether outputID refers to a spilled output still on disk
+func (s *Server) hasOutput(outputID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range s.outputs {
+		if id == outputID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputCapture(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{name: "empty", limit: 10, writes: nil, want: ""},
+		{name: "within the limit", limit: 10, writes: []string{"hello", " you"}, want: "hello you"},
+		{name: "exactly the limit", limit: 10, writes: []string{"0123456789"}, want: "0123456789"},
+		{name: "over the limit in one write", limit: 10, writes: []string{"0123456789abcdef"},
+			want: "01234\n... [6 bytes truncated] ...\nbcdef", truncated: true},
+		{name: "over the limit in many writes", limit: 10, writes: []string{"0123", "4567", "89ab", "cdef", "ghij"},
+			want: "01234\n... [10 bytes truncated] ...\nfghij", truncated: true},
+		{name: "cut characters are dropped", limit: 6, writes: []string{"aéé", "xyz", "ééb"},
+			want: "aé\n... [7 bytes truncated] ...\néb", truncated: true},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "out")
+		c := newOutputCapture(tt.limit, path)
+		var all strings.Builder
+		for _, w := range tt.writes {
+			c.Write([]byte(w))
+			all.WriteString(w)
+		}
+		c.close()
+
+		if got := c.String(); got != tt.want {
+			t.Errorf("%s: String() = %q, want %q", tt.name, got, tt.want)
+		}
+		if c.truncated != tt.truncated || c.spilled() != tt.truncated {
+			t.Errorf("%s: truncated %v, spilled %v, want %v", tt.name, c.truncated, c.spilled(), tt.truncated)
+		}
+		if c.total != int64(all.Len()) {
+			t.Errorf("%s: total = %d, want %d", tt.name, c.total, all.Len())
+		}
+
+		// The spill file has the whole output
+		if tt.truncated {
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != all.String() {
+				t.Errorf("%s: spill file = %q (%v), want %q", tt.name, data, err, all.String())
+			}
+		}
+	}
+}
+
+func TestChunkLog(t *testing.T) {
+	type add struct {
+		stream   string
+		offsetMs int64
+		data     string
+	}
+	tests := []struct {
+		name      string
+		limit     int
+		adds      []add
+		want      []OutputChunk
+		truncated bool
+	}{
+		{
+			name:  "streams interleaved",
+			limit: 100,
+			adds:  []add{{StreamStdout, 0, "a"}, {StreamStderr, 1, "b"}, {StreamStdout, 2, "c"}},
+			want:  []OutputChunk{{Stream: StreamStdout, OffsetMs: 0, Data: "a"}, {Stream: StreamStderr, OffsetMs: 1, Data: "b"}, {Stream: StreamStdout, OffsetMs: 2, Data: "c"}},
+		},
+		{
+			name:  "same stream and millisecond merged",
+			limit: 100,
+			adds:  []add{{StreamStdout, 5, "ab"}, {StreamStdout, 5, "cd"}, {StreamStdout, 6, "e"}},
+			want:  []OutputChunk{{Stream: StreamStdout, OffsetMs: 5, Data: "abcd"}, {Stream: StreamStdout, OffsetMs: 6, Data: "e"}},
+		},
+		{
+			name:  "character split between reads",
+			limit: 100,
+			adds:  []add{{StreamStdout, 0, "x\xc3"}, {StreamStderr, 1, "err"}, {StreamStdout, 2, "\xa9y"}},
+			want:  []OutputChunk{{Stream: StreamStdout, OffsetMs: 0, Data: "x"}, {Stream: StreamStderr, OffsetMs: 1, Data: "err"}, {Stream: StreamStdout, OffsetMs: 2, Data: "éy"}},
+		},
+		{
+			name:      "middle dropped past the limit",
+			limit:     6,
+			adds:      []add{{StreamStdout, 0, "abcd"}, {StreamStderr, 1, "efgh"}, {StreamStdout, 2, "ij"}},
+			want:      []OutputChunk{{Stream: StreamStdout, OffsetMs: 0, Data: "abc"}, {Stream: StreamStderr, OffsetMs: 1, Data: "h"}, {Stream: StreamStdout, OffsetMs: 2, Data: "ij"}},
+			truncated: true,
+		},
+		{
+			name:      "whole chunks dropped past the limit",
+			limit:     4,
+			adds:      []add{{StreamStdout, 0, "ab"}, {StreamStderr, 1, "cd"}, {StreamStdout, 2, "ef"}, {StreamStderr, 3, "gh"}},
+			want:      []OutputChunk{{Stream: StreamStdout, OffsetMs: 0, Data: "ab"}, {Stream: StreamStderr, OffsetMs: 3, Data: "gh"}},
+			truncated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		l := &chunkLog{limit: tt.limit}
+		for _, a := range tt.adds {
+			l.add(a.stream, a.offsetMs, []byte(a.data))
+		}
+
+		got := l.chunks()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: chunks() = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: chunk %d = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+		if l.truncated != tt.truncated {
+			t.Errorf("%s: truncated = %v, want %v", tt.name, l.truncated, tt.truncated)
+		}
+	}
+}
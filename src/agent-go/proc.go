@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// procStat holds the fields of /proc/<pid>/stat the agent cares about
+type procStat struct {
+	pid   int
+	state byte
+	ppid  int
+	pgrp  int
+}
+
+// readProcStat parses /proc/<pid>/stat
+func readProcStat(pid int) (*procStat, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is wrapped in parentheses and may itself contain
+	// spaces or parentheses, so parse from the last closing one
+	line := string(data)
+	end := strings.LastIndexByte(line, ')')
+	if end < 0 {
+		return nil, syscall.EINVAL
+	}
+	fields := strings.Fields(line[end+1:])
+	if len(fields) < 3 {
+		return nil, syscall.EINVAL
+	}
+
+	ppid, _ := strconv.Atoi(fields[1])
+	pgrp, _ := strconv.Atoi(fields[2])
+	return &procStat{
+		pid:   pid,
+		state: fields[0][0],
+		ppid:  ppid,
+		pgrp:  pgrp,
+	}, nil
+}
+
+// processGroupMembers returns the live (non-zombie) processes in a process group
+func processGroupMembers(pgid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+		if stat.pgrp == pgid && stat.state != 'Z' {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// killProcessGroup sends SIGTERM to a process group, waits up to grace for it
+// to exit and then SIGKILLs whatever is left. It returns the PIDs that had to
+// be force-killed.
+func killProcessGroup(pgid int, grace time.Duration) []int {
+	syscall.Kill(-pgid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		if len(processGroupMembers(pgid)) == 0 {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	remaining := processGroupMembers(pgid)
+	if len(remaining) > 0 {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	return remaining
+}
+
+// oomKillRecord matches the kernel log line the OOM killer writes for its victim
+var oomKillRecord = regexp.MustCompile(`Killed process (\d+)`)
+
+// monotonicNow returns the kernel's monotonic clock, which /dev/kmsg timestamps use
+func monotonicNow() time.Duration {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return time.Duration(ts.Nano())
+}
+
+// kmsgOOMKills returns the PIDs the OOM killer has killed since the given
+// monotonic time, from the kernel log in /dev/kmsg
+func kmsgOOMKills(since time.Duration) []int {
+	// Read with raw syscalls: through os.File the runtime poller would wait
+	// for more records instead of returning EAGAIN at the end of the log
+	fd, err := unix.Open("/dev/kmsg", unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(fd)
+
+	var pids []int
+	buf := make([]byte, 8192) // Each read returns one whole record
+	for {
+		n, err := unix.Read(fd, buf)
+		if errors.Is(err, unix.EPIPE) {
+			continue // The record was overwritten while reading; move on to the next
+		}
+		if err != nil || n <= 0 {
+			return pids
+		}
+
+		// Records are "priority,sequence,microseconds,flags;message"
+		header, msg, ok := bytes.Cut(buf[:n], []byte{';'})
+		if !ok {
+			continue
+		}
+		fields := bytes.Split(header, []byte{','})
+		if len(fields) < 3 {
+			continue
+		}
+		usec, _ := strconv.ParseInt(string(fields[2]), 10, 64)
+		if time.Duration(usec)*time.Microsecond < since {
+			continue
+		}
+		if m := oomKillRecord.FindSubmatch(msg); m != nil {
+			pid, _ := strconv.Atoi(string(m[1]))
+			pids = append(pids, pid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// executionProfile is a named set of defaults selected with ExecuteParams.Profile,
+// making commands non-interactive and their results reproducible
+type executionProfile struct {
+	Env   map[string]string `json:"env,omitempty"`   // Set before the request's own env
+	Umask string            `json:"umask,omitempty"` // Octal, e.g. "022"
+}
+
+// ciEnv keeps tools from waiting on pagers, prompts and interactive installers
+var ciEnv = map[string]string{
+	"CI":                  "1",
+	"PAGER":               "cat",
+	"GIT_PAGER":           "cat",
+	"MANPAGER":            "cat",
+	"SYSTEMD_PAGER":       "",
+	"GIT_TERMINAL_PROMPT": "0",
+	"DEBIAN_FRONTEND":     "noninteractive",
+	"PIP_NO_INPUT":        "1",
+	"NPM_CONFIG_YES":      "true",
+}
+
+// builtinProfiles are available unless the agent config redefines them
+var builtinProfiles = map[string]*executionProfile{
+	"ci": {Env: ciEnv},
+	// hermetic also pins locale, time zone, timestamps and hashing
+	"hermetic": {
+		Env: mergeEnv(ciEnv, map[string]string{
+			"TZ":                "UTC",
+			"LANG":              "C.UTF-8",
+			"LC_ALL":            "C.UTF-8",
+			"SOURCE_DATE_EPOCH": "315532800", // 1980-01-01, the earliest time zip can store
+			"PYTHONHASHSEED":    "0",
+		}),
+		Umask: "022",
+	},
+}
+
+// mergeEnv returns the variables of base overridden by those of extra
+func mergeEnv(base, extra map[string]string) map[string]string {
+	env := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		env[k] = v
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	return env
+}
+
+// profile looks up an execution profile, preferring the agent config's definition
+func (s *Server) profile(name string) (*executionProfile, error) {
+	if p, ok := s.config.Profiles[name]; ok {
+		return p, nil
+	}
+	if p, ok := builtinProfiles[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown profile: %s", name)
+}
+
+// umask parses the profile's umask, returning nil if it sets none
+func (p *executionProfile) umask() (*int, error) {
+	if p.Umask == "" {
+		return nil, nil
+	}
+	mask, err := strconv.ParseUint(p.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return nil, fmt.Errorf("invalid umask: %s", p.Umask)
+	}
+	m := int(mask)
+	return &m, nil
+}
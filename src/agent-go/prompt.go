@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// promptTailBytes is how much of the end of the output is kept to find a prompt in
+const promptTailBytes = 512
+
+// promptKeywords matches lines that ask for input even when they end in a newline
+var promptKeywords = regexp.MustCompile(`(?i)\[y/n\]|\(y/n\)|\(yes/no(/\[fingerprint\])?\)|password|passphrase|press (any key|enter|return)|do you want to continue|proceed\?`)
+
+// promptTail returns the last line of output if it looks like a prompt:
+// either it asks for input in so many words, or the output stops mid-line
+// (prompts rarely end in a newline).
+func promptTail(recent []byte) string {
+	text := stripANSI(string(recent))
+	endsLine := strings.HasSuffix(text, "\n")
+
+	text = strings.TrimRight(text, " \t\r\n")
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		text = text[i+1:]
+	}
+	if text == "" {
+		return ""
+	}
+	if !endsLine || promptKeywords.MatchString(text) {
+		return text
+	}
+	return ""
+}
+
+// inputSyscalls are the system calls a process waiting for input blocks in
+var inputSyscalls = map[int]bool{
+	unix.SYS_READ:     true,
+	unix.SYS_READV:    true,
+	unix.SYS_PSELECT6: true,
+	unix.SYS_PPOLL:    true,
+}
+
+// blockedOnInput reports whether a process in the group is blocked reading one
+// of the given input files (by /proc/<pid>/fd link, e.g. the PTY slave)
+func blockedOnInput(pgid int, inputs []string) bool {
+	for _, pid := range processGroupMembers(pgid) {
+		stat, err := readProcStat(pid)
+		if err != nil || stat.state != 'S' {
+			continue
+		}
+
+		// "number arg0 arg1 ..." with arguments in hex, or "running"
+		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/syscall")
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 2 {
+			continue
+		}
+		nr, err := strconv.Atoi(fields[0])
+		if err != nil || !inputSyscalls[nr] {
+			continue
+		}
+
+		// read and readv name the file; for pselect and ppoll assume it is stdin
+		fd := uint64(0)
+		if nr == unix.SYS_READ || nr == unix.SYS_READV {
+			if fd, err = strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 32); err != nil {
+				continue
+			}
+		}
+		link, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/fd/" + strconv.FormatUint(fd, 10))
+		if err != nil {
+			continue
+		}
+		for _, input := range inputs {
+			if link == input {
+				return true
+			}
+		}
+	}
+	return false
+}
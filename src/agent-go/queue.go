@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// execQueue limits how many executions run at once. Executions over the
+// limit wait in a queue ordered by priority (higher first), then arrival.
+type execQueue struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiting queueHeap
+	seq     uint64
+}
+
+// queueEntry is an execution waiting for a slot
+type queueEntry struct {
+	priority int
+	seq      uint64
+	index    int           // Position in the heap, -1 once removed
+	ready    chan struct{} // Closed when the slot is handed over
+}
+
+// newExecQueue creates a queue allowing limit concurrent executions
+func newExecQueue(limit int) *execQueue {
+	return &execQueue{limit: limit}
+}
+
+// acquire waits for a slot, returning how long it waited. It returns false if
+// ctx or cancelCh ended the wait first, in which case no slot is held.
+func (q *execQueue) acquire(ctx context.Context, cancelCh <-chan struct{}, priority int) (time.Duration, bool) {
+	start := time.Now()
+
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return 0, true
+	}
+	q.seq++
+	entry := &queueEntry{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, entry)
+	q.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return time.Since(start), true
+	case <-ctx.Done():
+	case <-cancelCh:
+	}
+
+	q.mu.Lock()
+	if entry.index >= 0 {
+		heap.Remove(&q.waiting, entry.index)
+		q.mu.Unlock()
+		return time.Since(start), false
+	}
+	q.mu.Unlock()
+
+	// The slot was handed over just as the wait ended; pass it on
+	q.release()
+	return time.Since(start), false
+}
+
+// release frees a slot, handing it to the first waiting execution if any
+func (q *execQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) > 0 {
+		entry := heap.Pop(&q.waiting).(*queueEntry)
+		close(entry.ready)
+		return
+	}
+	q.running--
+}
+
+// queueHeap orders waiting executions for container/heap
+type queueHeap []*queueEntry
+
+func (h queueHeap) Len() int { return len(h) }
+
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h queueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *queueHeap) Push(x any) {
+	entry := x.(*queueEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *queueHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
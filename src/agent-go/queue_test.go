@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n executions are waiting in q
+func waitQueued(t *testing.T, q *execQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		waiting := len(q.waiting)
+		q.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d executions waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExecQueueOrder(t *testing.T) {
+	q := newExecQueue(1)
+	if _, ok := q.acquire(context.Background(), nil, 0); !ok {
+		t.Fatal("first acquire failed")
+	}
+
+	// Queued one at a time, so arrival order is known
+	priorities := []int{0, 5, 0, 10, 5}
+	order := make(chan int, len(priorities))
+	for i, p := range priorities {
+		go func(i, p int) {
+			if _, ok := q.acquire(context.Background(), nil, p); ok {
+				order <- i
+			}
+		}(i, p)
+		waitQueued(t, q, i+1)
+	}
+
+	want := []int{3, 1, 4, 0, 2} // Higher priority first, then first come
+	for _, w := range want {
+		q.release()
+		select {
+		case got := <-order:
+			if got != w {
+				t.Fatalf("execution %d got the slot, want %d", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no execution got the slot, want %d", w)
+		}
+	}
+	q.release()
+
+	if q.running != 0 || len(q.waiting) != 0 {
+		t.Errorf("running %d, waiting %d after all released, want 0, 0", q.running, len(q.waiting))
+	}
+}
+
+func TestExecQueueCancel(t *testing.T) {
+	q := newExecQueue(1)
+	q.acquire(context.Background(), nil, 0)
+
+	cancelCh := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		_, ok := q.acquire(context.Background(), cancelCh, 0)
+		result <- ok
+	}()
+	waitQueued(t, q, 1)
+
+	close(cancelCh)
+	if <-result {
+		t.Fatal("cancelled acquire got a slot")
+	}
+	waitQueued(t, q, 0)
+
+	// The cancelled execution must not have taken the slot with it
+	q.release()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, ok := q.acquire(ctx, nil, 0); !ok {
+		t.Fatal("slot not free after the only holder released it")
+	}
+}
+
+func TestExecQueueCancelDuringHandover(t *testing.T) {
+	// Cancelling just as the slot is handed over must pass it on, not lose it
+	for i := 0; i < 200; i++ {
+		q := newExecQueue(1)
+		q.acquire(context.Background(), nil, 0)
+
+		cancelCh := make(chan struct{})
+		first := make(chan bool)
+		go func() {
+			_, ok := q.acquire(context.Background(), cancelCh, 1)
+			first <- ok
+		}()
+		waitQueued(t, q, 1)
+
+		second := make(chan bool)
+		go func() {
+			_, ok := q.acquire(context.Background(), nil, 0)
+			second <- ok
+		}()
+		waitQueued(t, q, 2)
+
+		go q.release()
+		close(cancelCh)
+		if <-first {
+			q.release()
+		}
+
+		select {
+		case <-second:
+		case <-time.After(5 * time.Second):
+			t.Fatal("slot was lost when the waiting execution was cancelled")
+		}
+		q.release()
+
+		if q.running != 0 || len(q.waiting) != 0 {
+			t.Fatalf("running %d, waiting %d after all released, want 0, 0", q.running, len(q.waiting))
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sourcegraph/jsonrpc2"
@@ -69,12 +71,29 @@ func (c *fdConn) Close() error {
 // Server manages the guest agent's network listeners and connections
 type Server struct {
 	startTime time.Time
+	execSeq   uint64 // Counter for execution IDs, accessed atomically
+	config    *agentConfig
+	queue     *execQueue // Limits concurrent execute and execute_stream calls
+
+	mu         sync.Mutex
+	executions map[string]*execution // In-flight executions by ID
+	outputs    []string              // IDs of spilled outputs on disk, oldest first
+	jobs       map[string]*job       // Background processes by ID, kept after they exit
+	jobOrder   []string              // Job IDs, oldest first
+	shells     map[string]*shell     // Persistent shells by name
+	history    []*ExecutionRecord    // Finished executions, oldest first
 }
 
 // NewServer creates a new Server instance
 func NewServer() *Server {
+	config := loadAgentConfig(AgentConfigPath)
 	return &Server{
-		startTime: time.Now(),
+		startTime:  time.Now(),
+		config:     config,
+		queue:      newExecQueue(config.maxConcurrentExecutions()),
+		executions: make(map[string]*execution),
+		jobs:       make(map[string]*job),
+		shells:     make(map[string]*shell),
 	}
 }
 
@@ -139,9 +158,21 @@ func (s *Server) handleVSockConnection(fd int) {
 	fmt.Println("[Otus Agent] VSock client connected")
 	defer fmt.Println("[Otus Agent] VSock client disconnected")
 
-	// Create jsonrpc2 connection with newline-delimited JSON codec
+	// The connection context is cancelled on disconnect, which stops waits
+	// done on behalf of this connection (expect). Commands (execute,
+	// execute_stream, graph steps) keep running until cancel or their
+	// timeouts, so their results can be fetched with get_execution after
+	// reconnecting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Working directory and environment set by this connection
+	ctx = withConnState(ctx, newConnState())
+
+	// Create jsonrpc2 connection with newline-delimited JSON codec.
+	// Requests are handled asynchronously so that cancel can reach a running execute.
 	stream := jsonrpc2.NewBufferedStream(conn, NewlineObjectCodec{})
-	rpcConn := jsonrpc2.NewConn(context.Background(), stream, jsonrpc2.HandlerWithError(s.handle))
+	rpcConn := jsonrpc2.NewConn(ctx, stream, jsonrpc2.AsyncHandler(jsonrpc2.HandlerWithError(s.handle)))
 
 	// Wait for connection to close
 	<-rpcConn.DisconnectNotify()
@@ -158,7 +189,42 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
-		result, err := s.handleExecute(&params)
+		connStateFrom(c).applyToExecute(&params)
+		result, err := s.handleExecute(c, conn, req.ID, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "execute_stream":
+		var params ExecuteParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		connStateFrom(c).applyToExecute(&params)
+		result, err := s.handleExecuteStream(c, conn, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "cancel":
+		var params CancelParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleCancel(conn, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "read_output":
+		var params ReadOutputParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleReadOutput(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
 		}
@@ -169,6 +235,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		params.Path = connStateFrom(c).resolve(params.Path)
 		result, err := s.handleReadFile(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -180,6 +247,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		params.Path = connStateFrom(c).resolve(params.Path)
 		result, err := s.handleWriteFile(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -191,6 +259,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		params.Path = connStateFrom(c).resolve(params.Path)
 		result, err := s.handleListDir(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -202,6 +271,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		params.BasePath = connStateFrom(c).resolveDir(params.BasePath)
 		result, err := s.handleSyncToGuest(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -213,6 +283,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		params.BasePath = connStateFrom(c).resolveDir(params.BasePath)
 		result, err := s.handleSyncFromGuest(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -224,6 +295,7 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
 		}
+		connStateFrom(c).applyToSession(&params)
 		result, err := s.handleStartSession(&params)
 		if err != nil {
 			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
@@ -270,11 +342,183 @@ func (s *Server) handle(c context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Re
 		}
 		return result, nil
 
+	case "shell_open":
+		var params ShellOpenParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleShellOpen(connStateFrom(c), &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "shell_run":
+		var params ShellRunParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleShellRun(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "shell_close":
+		var params ShellCloseParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleShellClose(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "list_executions":
+		var params ListExecutionsParams
+		if req.Params != nil {
+			if err := json.Unmarshal(*req.Params, &params); err != nil {
+				return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+			}
+		}
+		return s.handleListExecutions(&params), nil
+
+	case "get_execution":
+		var params GetExecutionParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleGetExecution(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "execute_graph":
+		var params ExecuteGraphParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleExecuteGraph(c, connStateFrom(c), conn, req.ID, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "expect":
+		var params ExpectParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleExpect(c, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "spawn_process":
+		var params SpawnProcessParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		connStateFrom(c).applyToExecute(&params.ExecuteParams)
+		result, err := s.handleSpawnProcess(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "process_status":
+		var params ProcessIDParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleProcessStatus(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "read_process_output":
+		var params ReadProcessOutputParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleReadProcessOutput(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "wait_process":
+		var params WaitProcessParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleWaitProcess(c, &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "signal_process":
+		var params SignalProcessParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleSignalProcess(&params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "set_env":
+		var params SetEnvParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleSetEnv(connStateFrom(c), &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "unset_env":
+		var params UnsetEnvParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleUnsetEnv(connStateFrom(c), &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "chdir":
+		var params ChdirParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, &jsonrpc2.Error{Code: InvalidParams, Message: "Invalid params"}
+		}
+		result, err := s.handleChdir(connStateFrom(c), &params)
+		if err != nil {
+			return nil, &jsonrpc2.Error{Code: ExecutionError, Message: err.Error()}
+		}
+		return result, nil
+
+	case "get_context":
+		return connStateFrom(c).snapshot(), nil
+
 	default:
 		return nil, &jsonrpc2.Error{Code: MethodNotFound, Message: "Method not found"}
 	}
 }
 
+// nextExecutionID returns a unique identifier for a new execution
+func (s *Server) nextExecutionID() string {
+	return fmt.Sprintf("exec-%d", atomic.AddUint64(&s.execSeq, 1))
+}
+
 // Uptime returns the server uptime in seconds
 func (s *Server) Uptime() float64 {
 	return time.Since(s.startTime).Seconds()
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shell is a persistent bash process opened with shell_open. Commands run
+// in it keep their effects (variables, functions, cwd, activated venvs)
+// across shell_run calls. Each command is followed by a sentinel marker on
+// stdout and stderr, so its output and exit code can be told apart.
+type shell struct {
+	name  string
+	e     *execution
+	stdin *os.File
+
+	runMu sync.Mutex // Serializes shell_run calls
+
+	mu  sync.Mutex
+	cur *shellRun // Command being run, nil between runs
+}
+
+// shellRun collects the output of one command run in a shell
+type shellRun struct {
+	marker   []byte // "\n__OTUS_<token>__ ", followed by the exit code on stdout
+	stdout   shellStream
+	stderr   shellStream
+	exitCode int
+	done     chan struct{} // Closed once both markers have been seen
+}
+
+// shellStream separates a command's output on one stream from its marker
+type shellStream struct {
+	capture *outputCapture
+	pending []byte // Unflushed bytes that might be the start of the marker
+	seen    bool
+	after   []byte // Bytes after the marker, until its line ends
+}
+
+// feed scans a chunk of shell output for the marker, passing the command's
+// output to the capture. It returns true once the marker line is complete.
+func (st *shellStream) feed(marker, data []byte) bool {
+	if st.seen {
+		st.after = append(st.after, data...)
+		return bytes.IndexByte(st.after, '\n') >= 0
+	}
+
+	st.pending = append(st.pending, data...)
+	if i := bytes.Index(st.pending, marker); i >= 0 {
+		st.capture.Write(st.pending[:i])
+		st.seen = true
+		st.after = append([]byte(nil), st.pending[i+len(marker):]...)
+		st.pending = nil
+		return bytes.IndexByte(st.after, '\n') >= 0
+	}
+
+	// Keep enough bytes back to find a marker split across chunks
+	if keep := len(marker) - 1; len(st.pending) > keep {
+		flush := len(st.pending) - keep
+		st.capture.Write(st.pending[:flush])
+		st.pending = append([]byte(nil), st.pending[flush:]...)
+	}
+	return false
+}
+
+// feed is the onOutput hook of the shell's execution
+func (sh *shell) feed(stream string, data []byte) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	run := sh.cur
+	if run == nil {
+		// Output between commands, e.g. from a background job, belongs to no run
+		return
+	}
+
+	if stream == StreamStderr {
+		if !run.stderr.seen || !bytes.Contains(run.stderr.after, []byte{'\n'}) {
+			run.stderr.feed(run.marker, data)
+		}
+	} else if !run.stdout.seen || !bytes.Contains(run.stdout.after, []byte{'\n'}) {
+		if run.stdout.feed(run.marker, data) {
+			line := run.stdout.after[:bytes.IndexByte(run.stdout.after, '\n')]
+			run.exitCode, _ = strconv.Atoi(string(line))
+		}
+	}
+
+	if run.complete() {
+		close(run.done)
+		sh.cur = nil
+	}
+}
+
+// complete reports whether both markers have been fully received
+func (run *shellRun) complete() bool {
+	return run.stdout.seen && bytes.Contains(run.stdout.after, []byte{'\n'}) &&
+		run.stderr.seen && bytes.Contains(run.stderr.after, []byte{'\n'})
+}
+
+// getShell looks up an open shell by name
+func (s *Server) getShell(name string) *shell {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shells[name]
+}
+
+// ========== Stateful shell handlers ==========
+
+// handleShellOpen starts a persistent bash process under a name
+func (s *Server) handleShellOpen(st *connState, params *ShellOpenParams) (*ShellResult, error) {
+	if params.Name == "" {
+		return &ShellResult{Success: false, Error: "shell name is required"}, nil
+	}
+
+	if sh := s.getShell(params.Name); sh != nil && sh.e.finished() == nil {
+		return &ShellResult{Name: params.Name, Success: true}, nil // Already open
+	}
+
+	execParams := &ExecuteParams{
+		Argv:    []string{"bash", "--noprofile", "--norc"},
+		Cwd:     params.Cwd,
+		Env:     params.Env,
+		User:    params.User,
+		Profile: params.Profile,
+	}
+	st.applyToExecute(execParams)
+
+	e, err := s.newExecution(execParams)
+	if err != nil {
+		return &ShellResult{Name: params.Name, Success: false, Error: err.Error()}, nil
+	}
+	// The shell lives until closed; output is collected per command instead
+	e.timeout = 0
+	e.capture = false
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		e.release()
+		return nil, err
+	}
+	e.cmd.Stdin = r
+	e.closers = append(e.closers, r, w)
+
+	sh := &shell{name: params.Name, e: e, stdin: w}
+	e.onOutput = sh.feed
+
+	go s.runExecution(context.Background(), e)
+	<-e.started
+	// The shell has its own copy of the read end
+	r.Close()
+
+	if res := e.finished(); res != nil && e.cmd.Process == nil {
+		return &ShellResult{Name: params.Name, Success: false, Error: res.Stderr}, nil
+	}
+
+	s.mu.Lock()
+	s.shells[params.Name] = sh
+	s.mu.Unlock()
+
+	return &ShellResult{Name: params.Name, Success: true}, nil
+}
+
+// handleShellRun runs a command in a shell and returns its own output and exit code.
+// If the command times out the shell is killed, since it cannot be interrupted reliably.
+func (s *Server) handleShellRun(params *ShellRunParams) (*ShellRunResult, error) {
+	sh := s.getShell(params.Name)
+	if sh == nil {
+		return nil, fmt.Errorf("shell %s does not exist", params.Name)
+	}
+
+	command, err := base64.StdEncoding.DecodeString(params.Command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 command: %w", err)
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	maxStdout := params.MaxStdoutBytes
+	if maxStdout <= 0 {
+		maxStdout = DefaultMaxOutputBytes
+	}
+	maxStderr := params.MaxStderrBytes
+	if maxStderr <= 0 {
+		maxStderr = DefaultMaxOutputBytes
+	}
+
+	sh.runMu.Lock()
+	defer sh.runMu.Unlock()
+
+	if sh.e.finished() != nil {
+		return nil, fmt.Errorf("shell %s has exited", params.Name)
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+	marker := fmt.Sprintf("__OTUS_%s__", hex.EncodeToString(token))
+
+	id := s.nextExecutionID()
+	run := &shellRun{
+		marker: []byte("\n" + marker + " "),
+		stdout: shellStream{capture: newOutputCapture(maxStdout, spillPath(id, StreamStdout))},
+		stderr: shellStream{capture: newOutputCapture(maxStderr, spillPath(id, StreamStderr))},
+		done:   make(chan struct{}),
+	}
+
+	// eval keeps the command's effects in the shell, and stdin is redirected
+	// so the command cannot swallow the lines that follow it
+	script := fmt.Sprintf(
+		"eval \"$(printf %%s '%s' | base64 -d)\" </dev/null\n"+
+			"__otus_rc=$?; printf '\\n%s %%d\\n' \"$__otus_rc\"; printf '\\n%s 0\\n' >&2\n",
+		base64.StdEncoding.EncodeToString(command), marker, marker)
+
+	sh.mu.Lock()
+	sh.cur = run
+	sh.mu.Unlock()
+
+	startTime := time.Now()
+	if _, err := sh.stdin.Write([]byte(script)); err != nil {
+		sh.mu.Lock()
+		sh.cur = nil
+		sh.mu.Unlock()
+		return nil, fmt.Errorf("failed to write to shell: %w", err)
+	}
+
+	result := &ShellRunResult{ExecuteResult: &ExecuteResult{ExecutionID: id}}
+	select {
+	case <-run.done:
+		result.ExitCode = run.exitCode
+	case <-sh.e.done:
+		// The command exited the shell (e.g. with exit)
+		result.ExitCode = sh.e.res.ExitCode
+		result.ShellExited = true
+	case <-time.After(time.Duration(timeout) * time.Second):
+		result.ExitCode = -1
+		result.TimedOut = true
+		result.ShellExited = true
+		s.closeShell(sh)
+	}
+
+	sh.mu.Lock()
+	sh.cur = nil
+	sh.mu.Unlock()
+	sh.e.mu.Lock() // Wait for a feed in progress to finish with the run
+	sh.e.mu.Unlock()
+
+	// Whatever is still held back could not have been a marker
+	run.stdout.capture.Write(run.stdout.pending)
+	run.stderr.capture.Write(run.stderr.pending)
+	run.stdout.capture.close()
+	run.stderr.capture.close()
+
+	result.DurationMs = time.Since(startTime).Milliseconds()
+	result.Stdout = run.stdout.capture.String()
+	result.Stderr = run.stderr.capture.String()
+	result.StdoutBytes = run.stdout.capture.total
+	result.StderrBytes = run.stderr.capture.total
+	result.StdoutTruncated = run.stdout.capture.truncated
+	result.StderrTruncated = run.stderr.capture.truncated
+	if run.stdout.capture.spilled() || run.stderr.capture.spilled() {
+		result.OutputID = id
+		s.trackOutput(id)
+	}
+
+	encodeOutput(result.ExecuteResult, EncodingAuto)
+
+	if result.ShellExited {
+		s.mu.Lock()
+		if s.shells[sh.name] == sh {
+			delete(s.shells, sh.name)
+		}
+		s.mu.Unlock()
+	}
+	return result, nil
+}
+
+// handleShellClose terminates a shell
+func (s *Server) handleShellClose(params *ShellCloseParams) (*ShellResult, error) {
+	sh := s.getShell(params.Name)
+	if sh == nil {
+		return &ShellResult{Success: false, Error: fmt.Sprintf("shell %s does not exist", params.Name)}, nil
+	}
+
+	s.closeShell(sh)
+
+	s.mu.Lock()
+	if s.shells[sh.name] == sh {
+		delete(s.shells, sh.name)
+	}
+	s.mu.Unlock()
+
+	return &ShellResult{Name: params.Name, Success: true}, nil
+}
+
+// closeShell stops a shell's process group and waits for it to exit
+func (s *Server) closeShell(sh *shell) {
+	sh.stdin.Close()
+	sh.e.cancel()
+	sh.e.wait()
+}
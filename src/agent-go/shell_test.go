@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellStreamFeed(t *testing.T) {
+	marker := "\n__OTUS_0123456789abcdef__ "
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		after  string
+	}{
+		{name: "output with newline", input: "hello\n" + marker + "0\n", output: "hello\n", after: "0\n"},
+		{name: "output without newline", input: "hello" + marker + "3\n", output: "hello", after: "3\n"},
+		{name: "no output", input: marker + "0\n", output: "", after: "0\n"},
+		{name: "partial marker in output", input: "\n__OTUS_01\nmore" + marker + "1\n", output: "\n__OTUS_01\nmore", after: "1\n"},
+		{name: "other marker in output", input: "\n__OTUS_ffffffffffffffff__ 7\n" + marker + "0\n", output: "\n__OTUS_ffffffffffffffff__ 7\n", after: "0\n"},
+		{name: "text after the marker line", input: "x" + marker + "0\nlater", output: "x", after: "0\nlater"},
+	}
+
+	for _, tt := range tests {
+		// Whole, and split into chunks that cut the marker in different places
+		for _, size := range []int{len(tt.input), 1, 5} {
+			st := &shellStream{capture: newOutputCapture(DefaultMaxOutputBytes, filepath.Join(t.TempDir(), "out"))}
+
+			// Once the marker line is complete, the caller collects the rest itself
+			complete := false
+			for i := 0; i < len(tt.input); i += size {
+				chunk := tt.input[i:min(i+size, len(tt.input))]
+				if complete {
+					st.after = append(st.after, chunk...)
+					continue
+				}
+				complete = st.feed([]byte(marker), []byte(chunk))
+			}
+
+			if !complete {
+				t.Errorf("%s (chunks of %d): marker line not complete", tt.name, size)
+				continue
+			}
+			if got := st.capture.String(); got != tt.output {
+				t.Errorf("%s (chunks of %d): output = %q, want %q", tt.name, size, got, tt.output)
+			}
+			if got := string(st.after); got != tt.after {
+				t.Errorf("%s (chunks of %d): after = %q, want %q", tt.name, size, got, tt.after)
+			}
+		}
+	}
+}
+
+func TestShellStreamFeedIncomplete(t *testing.T) {
+	marker := []byte("\n__OTUS_0123456789abcdef__ ")
+	st := &shellStream{capture: newOutputCapture(DefaultMaxOutputBytes, filepath.Join(t.TempDir(), "out"))}
+
+	// Only as much output is held back as could be the start of a marker
+	first := "a longer line of some output\n__OTUS_0123"
+	if st.feed(marker, []byte(first)) {
+		t.Fatal("feed reported a complete marker line without a marker")
+	}
+	if got, want := st.capture.String(), first[:len(first)-len(marker)+1]; got != want {
+		t.Errorf("flushed output = %q, want %q", got, want)
+	}
+
+	// A marker without its line end is not complete yet
+	if st.feed(marker, []byte("456789abcdef__ 12")) {
+		t.Fatal("feed reported a complete marker line before its newline")
+	}
+	if !st.feed(marker, []byte("\n")) {
+		t.Fatal("feed did not report the marker line as complete")
+	}
+	if got, want := st.capture.String(), "a longer line of some output"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if got, want := string(st.after), "12\n"; got != want {
+		t.Errorf("after = %q, want %q", got, want)
+	}
+}
+
+// openTestShell opens a shell in a temporary directory and closes it when the test ends
+func openTestShell(t *testing.T, s *Server, name string) {
+	t.Helper()
+	res, err := s.handleShellOpen(newConnState(), &ShellOpenParams{Name: name, Cwd: t.TempDir()})
+	if err != nil || !res.Success {
+		t.Fatalf("shell_open: %v %+v", err, res)
+	}
+	t.Cleanup(func() { s.handleShellClose(&ShellCloseParams{Name: name}) })
+}
+
+// runInShell runs a command with shell_run and fails the test on an error
+func runInShell(t *testing.T, s *Server, params ShellRunParams) *ShellRunResult {
+	t.Helper()
+	params.Command = base64.StdEncoding.EncodeToString([]byte(params.Command))
+	res, err := s.handleShellRun(&params)
+	if err != nil {
+		t.Fatalf("shell_run: %v", err)
+	}
+	return res
+}
+
+func TestShellRun(t *testing.T) {
+	s := NewServer()
+	openTestShell(t, s, "test")
+
+	tests := []struct {
+		command  string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{command: "greeting=hello; cd /", stdout: "", exitCode: 0},
+		{command: "echo $greeting; pwd", stdout: "hello\n/\n", exitCode: 0},
+		{command: "printf 'no newline'", stdout: "no newline", exitCode: 0},
+		{command: "echo out; echo err >&2; false", stdout: "out\n", stderr: "err\n", exitCode: 1},
+		{command: "f() { return 4; }; f", exitCode: 4},
+		{command: "read line; echo \"read: $line\"", stdout: "read: \n", exitCode: 0},
+		{command: "printf '\\n'; printf '\\n' >&2", stdout: "\n", stderr: "\n", exitCode: 0},
+	}
+
+	for _, tt := range tests {
+		res := runInShell(t, s, ShellRunParams{Name: "test", Command: tt.command})
+		if res.Stdout != tt.stdout || res.Stderr != tt.stderr || res.ExitCode != tt.exitCode || res.ShellExited {
+			t.Errorf("%q: got stdout %q, stderr %q, exit code %d, shellExited %v; want %q, %q, %d",
+				tt.command, res.Stdout, res.Stderr, res.ExitCode, res.ShellExited, tt.stdout, tt.stderr, tt.exitCode)
+		}
+	}
+}
+
+func TestShellRunExit(t *testing.T) {
+	s := NewServer()
+	openTestShell(t, s, "exit")
+
+	res := runInShell(t, s, ShellRunParams{Name: "exit", Command: "echo bye; exit 3"})
+	if !res.ShellExited || res.ExitCode != 3 || res.Stdout != "bye\n" {
+		t.Errorf("got stdout %q, exit code %d, shellExited %v; want \"bye\\n\", 3, true", res.Stdout, res.ExitCode, res.ShellExited)
+	}
+
+	params := &ShellRunParams{Name: "exit", Command: base64.StdEncoding.EncodeToString([]byte("true"))}
+	if _, err := s.handleShellRun(params); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("shell_run after exit: err = %v, want the shell to be gone", err)
+	}
+}
+
+func TestShellRunTimeout(t *testing.T) {
+	s := NewServer()
+	openTestShell(t, s, "slow")
+
+	res := runInShell(t, s, ShellRunParams{Name: "slow", Command: "echo started; sleep 30", Timeout: 1})
+	if !res.TimedOut || !res.ShellExited || res.ExitCode != -1 {
+		t.Errorf("got timedOut %v, shellExited %v, exit code %d; want true, true, -1", res.TimedOut, res.ShellExited, res.ExitCode)
+	}
+	if res.Stdout != "started\n" {
+		t.Errorf("stdout = %q, want the output from before the timeout", res.Stdout)
+	}
+	if s.getShell("slow") != nil {
+		t.Error("shell still registered after timing out")
+	}
+}
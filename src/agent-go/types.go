@@ -1,6 +1,10 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
 
 // JSON-RPC error codes
 const (
@@ -36,21 +40,229 @@ type RPCError struct {
 }
 
 // ExecuteParams contains parameters for the execute method
-// Command is always base64-encoded to avoid multiline/escaping issues
+// Command is always base64-encoded to avoid multiline/escaping issues.
+// It is run by Interpreter (default: bash), unless Argv is given instead.
 type ExecuteParams struct {
-	Command string            `json:"command"`
-	Cwd     string            `json:"cwd,omitempty"`
-	Timeout int               `json:"timeout,omitempty"`
-	Env     map[string]string `json:"env,omitempty"`
+	Command       string            `json:"command,omitempty"`
+	Argv          []string          `json:"argv,omitempty"`        // Executed directly, without a shell
+	Interpreter   string            `json:"interpreter,omitempty"` // sh, bash, python3, node, ... or a path
+	Cwd           string            `json:"cwd,omitempty"`
+	Timeout       int               `json:"timeout,omitempty"`
+	IdleTimeout   int               `json:"idleTimeout,omitempty"` // Stop after this many seconds without stdout or stderr output
+	Env           map[string]string `json:"env,omitempty"`
+	UnsetEnv      []string          `json:"unsetEnv,omitempty"`      // Inherited variables to remove
+	GracePeriodMs int               `json:"gracePeriodMs,omitempty"` // SIGTERM to SIGKILL delay on timeout/cancel (default: 2000)
+	// Per-stream limits on output returned inline (default: 1 MiB each).
+	// Past the limit only the head and tail are returned and the rest is spilled to disk.
+	MaxStdoutBytes int `json:"maxStdoutBytes,omitempty"`
+	MaxStderrBytes int `json:"maxStderrBytes,omitempty"`
+	// Input for the command, either base64-encoded data or a guest file to
+	// redirect from (mutually exclusive). Without either, stdin is /dev/null.
+	// The file is resolved against Cwd and opened with User's permissions.
+	Stdin     string `json:"stdin,omitempty"`
+	StdinFile string `json:"stdinFile,omitempty"`
+	// Run on a pseudo-terminal instead of pipes. Output of both streams is
+	// merged into Stdout; stdin, if given, is typed into the terminal.
+	PTY       bool `json:"pty,omitempty"`
+	Rows      int  `json:"rows,omitempty"`      // Terminal height (default: 24)
+	Cols      int  `json:"cols,omitempty"`      // Terminal width (default: 80)
+	StripANSI bool `json:"stripAnsi,omitempty"` // Remove escape sequences and CRs from PTY output
+	// A PTY command that prints a prompt and then blocks reading the terminal
+	// is stopped early with waitingForInput, unless this is set. Doesn't apply
+	// to spawn_process, and without a PTY reads of stdin end at EOF instead.
+	AllowInputWait bool `json:"allowInputWait,omitempty"`
+
+	Limits *ResourceLimits `json:"limits,omitempty"`
+
+	// Run as this user instead of the agent's (name or UID, optionally ":group").
+	// HOME, USER and LOGNAME are set for the user.
+	User string `json:"user,omitempty"`
+
+	// Network access: "default" (the VM's network), "loopback" (only localhost)
+	// or "none", each non-default mode using a fresh network namespace
+	Network string `json:"network,omitempty"`
+
+	// How output is returned: "separate" (Stdout and Stderr, the default),
+	// "interleaved" (only Chunks, in arrival order) or "both"
+	Output string `json:"output,omitempty"`
+
+	// Encoding of output in the result: "auto" (the default) returns each
+	// stream and chunk as text if it is valid UTF-8 and as base64 otherwise;
+	// "utf8" and "base64" force one. Streamed output chooses per notification.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Position in the queue when the concurrency limit is reached: higher
+	// runs first (default: 0), e.g. a positive value for quick probes.
+	Priority int `json:"priority,omitempty"`
+
+	// Execution profile to apply: "ci" (no pagers or prompts), "hermetic"
+	// (also fixed locale, TZ, umask and SOURCE_DATE_EPOCH) or one defined in
+	// the agent config. Env overrides the profile's variables.
+	Profile string `json:"profile,omitempty"`
+}
+
+// ResourceLimits caps what a single command may use. Memory, CPU and pids
+// limits are enforced by a cgroup v2 leaf for the command; the others are
+// rlimits, where a zero value is a real limit (e.g. core: 0 disables core dumps).
+type ResourceLimits struct {
+	MemoryMaxBytes  int64   `json:"memoryMaxBytes,omitempty"`
+	CPUQuotaPercent int     `json:"cpuQuotaPercent,omitempty"` // 100 = one full CPU
+	PidsMax         int     `json:"pidsMax,omitempty"`
+	NoFile          *uint64 `json:"nofile,omitempty"` // Max open file descriptors
+	FileSize        *uint64 `json:"fsize,omitempty"`  // Max size of a written file in bytes
+	Core            *uint64 `json:"core,omitempty"`   // Max core dump size in bytes
 }
 
 // ExecuteResult contains the result of command execution
 type ExecuteResult struct {
-	Stdout     string `json:"stdout"`
-	Stderr     string `json:"stderr"`
-	ExitCode   int    `json:"exitCode"`
-	DurationMs int64  `json:"durationMs"`
-	TimedOut   bool   `json:"timedOut,omitempty"`
+	ExecutionID  string `json:"executionId,omitempty"`
+	Stdout       string `json:"stdout"`
+	Stderr       string `json:"stderr"`
+	ExitCode     int    `json:"exitCode"` // -1 if the command did not exit normally
+	DurationMs   int64  `json:"durationMs"`
+	QueuedMs     int64  `json:"queuedMs,omitempty"` // Time spent waiting for a slot before starting
+	TimedOut     bool   `json:"timedOut,omitempty"`
+	IdleTimedOut bool   `json:"idleTimedOut,omitempty"` // Stopped by idleTimeout (TimedOut is not set)
+	Cancelled    bool   `json:"cancelled,omitempty"`    // Stopped by cancel (not by the connection closing)
+	KilledPids   []int  `json:"killedPids,omitempty"`   // Processes that ignored SIGTERM and were SIGKILLed
+
+	WaitingForInput bool   `json:"waitingForInput,omitempty"` // Stopped because it was blocked on a prompt
+	Prompt          string `json:"prompt,omitempty"`          // The last line of output, which asked for input
+
+	StdoutBytes     int64  `json:"stdoutBytes"` // Total bytes produced, including truncated ones
+	StderrBytes     int64  `json:"stderrBytes"`
+	StdoutTruncated bool   `json:"stdoutTruncated,omitempty"`
+	StderrTruncated bool   `json:"stderrTruncated,omitempty"`
+	OutputID        string `json:"outputId,omitempty"` // Set when full output can be fetched with read_output
+
+	// Output of both streams in the order the agent read it, with output "interleaved" or "both".
+	// Bounded like the streams: past the combined limit only the first and last chunks are kept.
+	Chunks          []OutputChunk `json:"chunks,omitempty"`
+	ChunksTruncated bool          `json:"chunksTruncated,omitempty"`
+
+	// "utf8", or "base64" when the stream is base64-encoded (chunks say so themselves)
+	StdoutEncoding string `json:"stdoutEncoding,omitempty"`
+	StderrEncoding string `json:"stderrEncoding,omitempty"`
+
+	Usage *ResourceUsage `json:"usage,omitempty"` // Resources used by the command and its waited-for children
+
+	OOMKilled    bool `json:"oomKilled,omitempty"`    // A process was OOM-killed (per the cgroup, or else the kernel log)
+	PidsLimitHit bool `json:"pidsLimitHit,omitempty"` // A fork failed because of limits.pidsMax
+
+	Signal     string `json:"signal,omitempty"`     // Signal that killed the command, e.g. "SIGSEGV"
+	CoreDumped bool   `json:"coreDumped,omitempty"` // The signal produced a core dump
+	StartError string `json:"startError,omitempty"` // Why the command could not be started at all
+}
+
+// OutputChunk is a piece of output as it was read from one stream
+type OutputChunk struct {
+	Stream   string `json:"stream"`   // "stdout" or "stderr"
+	OffsetMs int64  `json:"offsetMs"` // Time since the command started
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"` // "base64" when Data is base64-encoded
+}
+
+// ResourceUsage reports what a finished command cost, from its rusage
+type ResourceUsage struct {
+	UserCPUMs              int64 `json:"userCpuMs"`
+	SystemCPUMs            int64 `json:"systemCpuMs"`
+	MaxRSSKb               int64 `json:"maxRssKb"`       // Peak resident set size of the largest process
+	BlockInputOps          int64 `json:"blockInputOps"`  // Filesystem reads that hit the block device
+	BlockOutputOps         int64 `json:"blockOutputOps"` // Filesystem writes that hit the block device
+	VoluntaryCtxSwitches   int64 `json:"voluntaryCtxSwitches"`
+	InvoluntaryCtxSwitches int64 `json:"involuntaryCtxSwitches"`
+}
+
+// ExecuteStreamResult is returned immediately by execute_stream
+type ExecuteStreamResult struct {
+	ExecutionID string `json:"executionId"`
+}
+
+// ExecuteStartedNotification tells the host the execution ID of an execute
+// request before it finishes (sent as the execute_started notification), so
+// the execution can be found again if the connection drops
+type ExecuteStartedNotification struct {
+	ExecutionID string      `json:"executionId"`
+	RequestID   jsonrpc2.ID `json:"requestId"`
+}
+
+// ExecuteOutputNotification carries a chunk of output from a streaming execution
+// (sent as the execute_output notification)
+type ExecuteOutputNotification struct {
+	ExecutionID string `json:"executionId"`
+	Seq         uint64 `json:"seq"`    // Increases by one per notification of an execution
+	Stream      string `json:"stream"` // "stdout" or "stderr"
+	Data        string `json:"data"`
+	Encoding    string `json:"encoding,omitempty"` // "base64" when Data is base64-encoded
+}
+
+// ExecuteExitNotification reports the end of a streaming execution
+// (sent as the execute_exit notification, after all output). Stdout and Stderr are empty.
+type ExecuteExitNotification struct {
+	ExecutionID string `json:"executionId"`
+	Seq         uint64 `json:"seq"`
+	*ExecuteResult
+}
+
+// ReadOutputParams contains parameters for reading spilled execution output
+type ReadOutputParams struct {
+	OutputID string `json:"outputId"`
+	Stream   string `json:"stream,omitempty"` // "stdout" (default) or "stderr"
+	Offset   int64  `json:"offset,omitempty"`
+	Length   int    `json:"length,omitempty"` // Bytes to read (default: 64 KiB, max: 4 MiB)
+}
+
+// ReadOutputResult contains a range of spilled output (base64 encoded)
+type ReadOutputResult struct {
+	Content   string `json:"content"`
+	Offset    int64  `json:"offset"`
+	BytesRead int    `json:"bytesRead"`
+	TotalSize int64  `json:"totalSize"`
+	EOF       bool   `json:"eof"`
+}
+
+// ========== Execution history types ==========
+
+// ListExecutionsParams contains parameters for list_executions
+type ListExecutionsParams struct {
+	Limit int `json:"limit,omitempty"` // Most recent executions to return (default: all remembered)
+}
+
+// ListExecutionsResult lists running and recent executions, newest first
+type ListExecutionsResult struct {
+	Executions []ExecutionRecord `json:"executions"`
+}
+
+// GetExecutionParams identifies an execution in the history
+type GetExecutionParams struct {
+	ExecutionID string `json:"executionId"`
+}
+
+// ExecutionRecord describes a queued, running or recently finished execution
+type ExecutionRecord struct {
+	ExecutionID string   `json:"executionId"`
+	Command     string   `json:"command"`
+	Cwd         string   `json:"cwd"`
+	EnvKeys     []string `json:"envKeys,omitempty"` // Variables the request set (values are not kept)
+	Queued      bool     `json:"queued,omitempty"`  // Waiting for a slot (see maxConcurrentExecutions), so not started
+	Running     bool     `json:"running"`
+	StartedAt   int64    `json:"startedAt,omitempty"` // Unix milliseconds
+	EndedAt     int64    `json:"endedAt,omitempty"`   // Unix milliseconds
+	DurationMs  int64    `json:"durationMs"`          // So far, if still running
+	ExitCode    int      `json:"exitCode"`            // Only meaningful once Running and Queued are false
+
+	// The result, only returned by get_execution. Stdout and Stderr are cut
+	// to their last 16 KiB (and chunks dropped); OutputID still refers to
+	// the full output while it is on disk.
+	Result *ExecuteResult `json:"result,omitempty"`
+}
+
+// CancelParams identifies the execution to cancel, either by execution ID
+// or by the JSON-RPC request ID of the execute call on the same connection.
+// The result is the cancelled execution's ExecuteResult with partial output.
+type CancelParams struct {
+	ExecutionID string       `json:"executionId,omitempty"`
+	RequestID   *jsonrpc2.ID `json:"requestId,omitempty"`
 }
 
 // HealthResult contains health check information
@@ -61,15 +273,37 @@ type HealthResult struct {
 }
 
 // ReadFileParams contains parameters for reading a file
+// Either a byte range (offset and length) or a line range (startLine and endLine)
+// can be read; both are cut short at maxBytes.
 type ReadFileParams struct {
-	Path string `json:"path"`
+	Path     string `json:"path"`
+	User     string `json:"user,omitempty"`     // Read with this user's permissions
+	Offset   int64  `json:"offset,omitempty"`   // First byte to read
+	Length   int64  `json:"length,omitempty"`   // Bytes to read (default: to the end)
+	MaxBytes int    `json:"maxBytes,omitempty"` // Most bytes returned (default: 8 MiB, max: 64 MiB)
+
+	// Lines to read, counted from 1 and inclusive (default: from the first, to the end)
+	StartLine int `json:"startLine,omitempty"`
+	EndLine   int `json:"endLine,omitempty"`
 }
 
 // ReadFileResult contains the result of reading a file
 type ReadFileResult struct {
-	Content string `json:"content"`
-	Exists  bool   `json:"exists"`
-	Size    int64  `json:"size,omitempty"`
+	Content   string     `json:"content"` // Base64; empty for line range reads
+	Exists    bool       `json:"exists"`
+	Size      int64      `json:"size,omitempty"`      // Total size of the file
+	Offset    int64      `json:"offset,omitempty"`    // Where the returned bytes or lines start
+	BytesRead int        `json:"bytesRead,omitempty"` // Length of the decoded content
+	Partial   bool       `json:"partial,omitempty"`   // Only part of the file was returned
+	Lines     []FileLine `json:"lines,omitempty"`     // For line range reads
+}
+
+// FileLine is a line returned by a line range read, without its line ending.
+// Invalid UTF-8 is replaced.
+type FileLine struct {
+	Number    int    `json:"number"`
+	Text      string `json:"text"`
+	Truncated bool   `json:"truncated,omitempty"` // Longer than maxBytes; read the rest by offset
 }
 
 // WriteFileParams contains parameters for writing a file
@@ -77,6 +311,7 @@ type WriteFileParams struct {
 	Path    string `json:"path"`
 	Content string `json:"content"`
 	Mode    int    `json:"mode,omitempty"`
+	User    string `json:"user,omitempty"` // Write as this user, who will own created files
 }
 
 // WriteFileResult contains the result of writing a file
@@ -89,6 +324,7 @@ type WriteFileResult struct {
 type ListDirParams struct {
 	Path      string `json:"path"`
 	Recursive bool   `json:"recursive,omitempty"`
+	User      string `json:"user,omitempty"` // List with this user's permissions
 }
 
 // DirEntry represents a directory entry
@@ -107,8 +343,9 @@ type ListDirResult struct {
 
 // SyncToGuestParams contains parameters for syncing files to the guest (tar-based)
 type SyncToGuestParams struct {
-	TarData  string `json:"tarData"` // Base64-encoded tar.gz
-	BasePath string `json:"basePath,omitempty"`
+	TarData  string `json:"tarData"`            // Base64-encoded tar.gz
+	BasePath string `json:"basePath,omitempty"` // Default: the connection's working directory
+	User     string `json:"user,omitempty"`     // Extract as this user, who will own the files
 }
 
 // SyncToGuestResult contains the result of syncing files to the guest
@@ -120,8 +357,9 @@ type SyncToGuestResult struct {
 
 // SyncFromGuestParams contains parameters for syncing files from the guest (tar-based)
 type SyncFromGuestParams struct {
-	BasePath string   `json:"basePath,omitempty"`
+	BasePath string   `json:"basePath,omitempty"` // Default: the connection's working directory
 	Excludes []string `json:"excludes,omitempty"` // Additional patterns to exclude
+	User     string   `json:"user,omitempty"`     // Archive with this user's permissions
 }
 
 // SyncFromGuestResult contains the result of syncing files from the guest
@@ -134,8 +372,11 @@ type SyncFromGuestResult struct {
 
 // StartSessionParams contains parameters for starting a tmux session
 type StartSessionParams struct {
-	Name string `json:"name"`          // Session name (required)
-	Cwd  string `json:"cwd,omitempty"` // Working directory (default: /workspace)
+	Name     string            `json:"name"`               // Session name (required)
+	Cwd      string            `json:"cwd,omitempty"`      // Working directory (default: /workspace)
+	User     string            `json:"user,omitempty"`     // Run the session's shell as this user
+	Env      map[string]string `json:"env,omitempty"`      // Extra environment for the session
+	UnsetEnv []string          `json:"unsetEnv,omitempty"` // Inherited variables to remove
 }
 
 // StartSessionResult contains the result of starting a session
@@ -194,3 +435,210 @@ type KillSessionResult struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
 }
+
+// ========== Stateful shell types ==========
+
+// ShellOpenParams contains parameters for opening a persistent shell
+type ShellOpenParams struct {
+	Name string            `json:"name"`           // Shell name (required)
+	Cwd  string            `json:"cwd,omitempty"`  // Initial working directory (default: /workspace)
+	User string            `json:"user,omitempty"` // Run the shell as this user
+	Env  map[string]string `json:"env,omitempty"`  // Extra environment for the shell
+	// Execution profile for the shell, as for execute
+	Profile string `json:"profile,omitempty"`
+}
+
+// ShellRunParams contains parameters for running a command in a shell
+type ShellRunParams struct {
+	Name           string `json:"name"`                     // Shell name
+	Command        string `json:"command"`                  // Base64-encoded command
+	Timeout        int    `json:"timeout,omitempty"`        // Timeout in seconds (default: 300); the shell is killed on timeout
+	MaxStdoutBytes int    `json:"maxStdoutBytes,omitempty"` // Stdout kept in the result (default: 1 MiB)
+	MaxStderrBytes int    `json:"maxStderrBytes,omitempty"` // Stderr kept in the result (default: 1 MiB)
+}
+
+// ShellRunResult contains the output and exit code of a single command
+type ShellRunResult struct {
+	*ExecuteResult
+	ShellExited bool `json:"shellExited,omitempty"` // The shell is gone (the command exited it, or it timed out)
+}
+
+// ShellCloseParams contains parameters for closing a shell
+type ShellCloseParams struct {
+	Name string `json:"name"` // Shell name to close
+}
+
+// ShellResult contains the result of opening or closing a shell
+type ShellResult struct {
+	Name    string `json:"name,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ========== Background process types ==========
+
+// SpawnProcessParams contains the parameters for spawn_process: those of
+// execute, where Timeout is optional (without it the process runs until it
+// exits), plus its own.
+type SpawnProcessParams struct {
+	ExecuteParams
+	// Give the process a stdin pipe that stays open, so expect can write to
+	// it (PTY processes can always be written to)
+	OpenStdin bool `json:"openStdin,omitempty"`
+}
+
+// ProcessIDParams identifies a background process
+type ProcessIDParams struct {
+	ID string `json:"id"`
+}
+
+// ProcessStatus describes a background process, running or finished
+type ProcessStatus struct {
+	ID           string `json:"id"`
+	Pid          int    `json:"pid"`
+	Command      string `json:"command"`
+	Running      bool   `json:"running"`
+	ExitCode     int    `json:"exitCode"`          // Only meaningful once Running is false
+	StartedAt    int64  `json:"startedAt"`         // Unix milliseconds
+	EndedAt      int64  `json:"endedAt,omitempty"` // Unix milliseconds
+	DurationMs   int64  `json:"durationMs"`        // So far, if still running
+	StdoutBytes  int64  `json:"stdoutBytes"`       // Output produced so far
+	StderrBytes  int64  `json:"stderrBytes"`
+	TimedOut     bool   `json:"timedOut,omitempty"`
+	IdleTimedOut bool   `json:"idleTimedOut,omitempty"`
+	Cancelled    bool   `json:"cancelled,omitempty"`
+	Error        string `json:"error,omitempty"` // Why the process failed to start
+	Signal       string `json:"signal,omitempty"`
+	CoreDumped   bool   `json:"coreDumped,omitempty"`
+	OOMKilled    bool   `json:"oomKilled,omitempty"`
+
+	Usage *ResourceUsage `json:"usage,omitempty"` // Set once the process has exited
+}
+
+// ReadProcessOutputParams contains parameters for reading background process output
+type ReadProcessOutputParams struct {
+	ID     string `json:"id"`
+	Stream string `json:"stream,omitempty"` // "stdout" (default) or "stderr"
+	Offset int64  `json:"offset,omitempty"` // Pass the previous nextOffset to read incrementally
+	Length int    `json:"length,omitempty"` // Max bytes to read (default: 64 KiB, max: 4 MiB)
+}
+
+// ReadProcessOutputResult contains a range of background process output (base64 encoded)
+type ReadProcessOutputResult struct {
+	Content    string `json:"content"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"nextOffset"`
+	TotalSize  int64  `json:"totalSize"` // Bytes of the stream written so far
+	Running    bool   `json:"running"`   // If false and nextOffset == totalSize, there is no more output
+}
+
+// WaitProcessParams contains parameters for waiting on a background process
+type WaitProcessParams struct {
+	ID      string `json:"id"`
+	Timeout int    `json:"timeout,omitempty"` // Seconds to wait (default: 300)
+}
+
+// SignalProcessParams contains parameters for signalling a background process
+type SignalProcessParams struct {
+	ID     string `json:"id"`
+	Signal string `json:"signal,omitempty"` // Name ("SIGINT", "INT") or number (default: SIGTERM)
+}
+
+// ========== Command graph types ==========
+
+// ExecuteGraphParams contains the steps for execute_graph
+type ExecuteGraphParams struct {
+	Steps []GraphStep `json:"steps"`
+}
+
+// GraphStep is a command that runs once the steps it depends on have
+// succeeded. It takes all execute parameters besides its own fields.
+type GraphStep struct {
+	Name         string   `json:"name"`
+	DependsOn    []string `json:"dependsOn,omitempty"`
+	AllowFailure bool     `json:"allowFailure,omitempty"` // Let dependents run even if this step fails
+	ExecuteParams
+}
+
+// ExecuteGraphResult reports every step, in the order given. Success is
+// false if a step failed without allowFailure or was skipped.
+type ExecuteGraphResult struct {
+	Success    bool              `json:"success"`
+	Steps      []GraphStepResult `json:"steps"`
+	DurationMs int64             `json:"durationMs"`
+}
+
+// GraphStepResult contains the outcome of one step
+type GraphStepResult struct {
+	Name   string         `json:"name"`
+	Status string         `json:"status"` // "succeeded", "failed" or "skipped"
+	Result *ExecuteResult `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"` // Why the step was skipped or could not be started
+}
+
+// ========== Expect types ==========
+
+// ExpectParams contains parameters for scripted interaction with a tmux
+// session or a background process (exactly one of Session and ProcessID).
+// For a session, the first step also sees what the pane shows at the start.
+type ExpectParams struct {
+	Session   string       `json:"session,omitempty"`
+	ProcessID string       `json:"processId,omitempty"`
+	Stream    string       `json:"stream,omitempty"` // Process output to match: "stdout" (default) or "stderr"
+	Offset    int64        `json:"offset,omitempty"` // Where to start in the process output (pass the previous nextOffset)
+	Steps     []ExpectStep `json:"steps"`
+}
+
+// ExpectStep waits for Pattern to appear in the output, then sends Send.
+// Either may be empty. Escape sequences are removed from terminal output before matching.
+type ExpectStep struct {
+	Pattern string `json:"pattern,omitempty"` // Regular expression (Go RE2 syntax)
+	Send    string `json:"send,omitempty"`    // Text to type; "\n" presses Enter
+	Timeout int    `json:"timeout,omitempty"` // Seconds to wait for the pattern (default: 30)
+}
+
+// ExpectResult reports each step that ran; on failure the last one is the step that failed
+type ExpectResult struct {
+	Success    bool               `json:"success"`
+	Steps      []ExpectStepResult `json:"steps"`
+	NextOffset int64              `json:"nextOffset,omitempty"` // For processes: the end of the output read
+	Error      string             `json:"error,omitempty"`
+}
+
+// ExpectStepResult contains what a step matched and the output leading up to it
+type ExpectStepResult struct {
+	Matched         bool     `json:"matched"`
+	Match           string   `json:"match,omitempty"`
+	Groups          []string `json:"groups,omitempty"` // Capture groups of the pattern
+	Output          string   `json:"output"`           // Output since the previous match, up to the end of this one
+	OutputTruncated bool     `json:"outputTruncated,omitempty"`
+	Sent            bool     `json:"sent,omitempty"`
+	TimedOut        bool     `json:"timedOut,omitempty"`
+}
+
+// ========== Connection context types ==========
+
+// SetEnvParams contains variables to add to the connection's default environment
+type SetEnvParams struct {
+	Env map[string]string `json:"env"`
+}
+
+// UnsetEnvParams contains variables to remove from the connection's default environment
+type UnsetEnvParams struct {
+	Keys []string `json:"keys"`
+}
+
+// ChdirParams contains the new default working directory (relative paths
+// are resolved against the current one)
+type ChdirParams struct {
+	Path string `json:"path"`
+	User string `json:"user,omitempty"` // Check access as this user rather than the agent
+}
+
+// ConnContextResult describes the defaults a connection applies to execute,
+// start_session and file calls that don't override them
+type ConnContextResult struct {
+	Cwd   string            `json:"cwd"`
+	Env   map[string]string `json:"env"`   // Variables set with set_env
+	Unset []string          `json:"unset"` // Variables removed with unset_env
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// userCred is a resolved user to run commands or file operations as
+type userCred struct {
+	name   string
+	home   string
+	uid    uint32
+	gid    uint32
+	groups []uint32 // Supplementary groups
+}
+
+// lookupUser resolves a user given as a name or numeric UID, optionally
+// followed by ":group" (name or GID) to override the primary group.
+// A numeric UID without a passwd entry is allowed, with "/" as its home.
+func lookupUser(spec string) (*userCred, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+
+	cred := &userCred{name: name, home: "/"}
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err == nil {
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cred.name = u.Username
+		cred.home = u.HomeDir
+		cred.uid = uint32(uid)
+		cred.gid = uint32(gid)
+
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if g, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(g) != cred.gid {
+					cred.groups = append(cred.groups, uint32(g))
+				}
+			}
+		}
+	} else {
+		uid, convErr := strconv.ParseUint(name, 10, 32)
+		if convErr != nil {
+			return nil, fmt.Errorf("unknown user: %s", name)
+		}
+		cred.uid = uint32(uid)
+		cred.gid = uint32(uid)
+	}
+
+	if hasGroup {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(group)
+			if lookupErr != nil {
+				return nil, fmt.Errorf("unknown group: %s", group)
+			}
+			gid, _ = strconv.ParseUint(g.Gid, 10, 32)
+		}
+		cred.gid = uint32(gid)
+	}
+
+	return cred, nil
+}
+
+// lookupOptionalUser resolves spec, returning nil for an empty spec
+func lookupOptionalUser(spec string) (*userCred, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	return lookupUser(spec)
+}
+
+// credential returns the credential for starting a process as the user
+func (c *userCred) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: c.uid, Gid: c.gid, Groups: c.groups}
+}
+
+// sessionCommand returns the command that starts a login shell as the user
+// inside a tmux session (the tmux server itself keeps running as the agent)
+func (c *userCred) sessionCommand() []string {
+	groups := "--clear-groups"
+	if len(c.groups) > 0 {
+		ids := make([]string, len(c.groups))
+		for i, g := range c.groups {
+			ids[i] = strconv.FormatUint(uint64(g), 10)
+		}
+		groups = "--groups=" + strings.Join(ids, ",")
+	}
+
+	args := []string{
+		"setpriv",
+		fmt.Sprintf("--reuid=%d", c.uid),
+		fmt.Sprintf("--regid=%d", c.gid),
+		groups,
+		"--",
+		"env",
+	}
+	args = append(args, c.env()...)
+	return append(args, "bash", "-l")
+}
+
+// env returns the environment variables identifying the user
+func (c *userCred) env() []string {
+	return []string{"HOME=" + c.home, "USER=" + c.name, "LOGNAME=" + c.name}
+}
+
+// withUserFS runs fn with filesystem access checked as user, so files it
+// creates are owned by the user and permissions are enforced. A nil user
+// runs fn as the agent. The filesystem IDs and groups are per-thread on
+// Linux, so fn runs on a thread locked for the duration.
+func withUserFS(cred *userCred, fn func() error) error {
+	if cred == nil {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+
+	origGroups, err := unix.Getgroups()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	groups := make([]int, len(cred.groups))
+	for i, g := range cred.groups {
+		groups[i] = int(g)
+	}
+
+	// The raw syscalls only affect this thread, unlike syscall.Setgroups
+	restore := func() bool {
+		unix.Setfsuid(os.Geteuid())
+		unix.Setfsgid(os.Getegid())
+		return unix.Setgroups(origGroups) == nil
+	}
+	if err := unix.Setgroups(groups); err != nil {
+		if restore() {
+			runtime.UnlockOSThread()
+		}
+		return fmt.Errorf("failed to switch user: %w", err)
+	}
+	unix.Setfsgid(int(cred.gid))
+	unix.Setfsuid(int(cred.uid))
+
+	err = fn()
+
+	// If the thread can't be restored, leave it locked so it exits with the goroutine
+	if restore() {
+		runtime.UnlockOSThread()
+	}
+	return err
+}
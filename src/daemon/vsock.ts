@@ -227,6 +227,17 @@ export class VSockConnection {
   }
 }
 
+/**
+ * Decode command output the agent returned base64-encoded (because it was
+ * not valid UTF-8) into text, replacing invalid bytes
+ */
+function decodeOutput(data: string, encoding?: string): string {
+  if (encoding === "base64") {
+    return Buffer.from(data, "base64").toString("utf8");
+  }
+  return data;
+}
+
 /**
  * High-level client for interacting with the guest agent
  */
@@ -282,7 +293,13 @@ export class GuestAgentClient {
       throw new Error(`Execution failed: ${response.error.message}`);
     }
 
-    return response.result as any;
+    // Output that is not valid UTF-8 comes back base64-encoded, per stream
+    const result = response.result as any;
+    return {
+      ...result,
+      stdout: decodeOutput(result.stdout, result.stdoutEncoding),
+      stderr: decodeOutput(result.stderr, result.stderrEncoding),
+    };
   }
 
   /**